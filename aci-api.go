@@ -15,18 +15,29 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"github.com/Knetic/govaluate"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"github.com/tidwall/gjson"
 	"github.com/umisama/go-regexpcache"
+	"hash/fnv"
+	"math"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 )
 
+var seriesDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: MetricsPrefix + "metric_series_dropped_total",
+	Help: "Number of series of fabric metrics dropped since the metric had more series than cardinality.max_series",
+},
+	[]string{"fabric", "metric"},
+)
+
 var arrayExtension = regexpcache.MustCompile("^(?P<stage_1>.*)\\.\\[(?P<child_name>.*)\\](?P<stage_2>.*)")
 
 func newAciAPI(ctx context.Context, fabricConfig Fabric, configQueries AllQueries, queryFilter string) *aciAPI {
@@ -61,90 +72,433 @@ func newAciAPI(ctx context.Context, fabricConfig Fabric, configQueries AllQuerie
 		executeQueries = configQueries
 	}
 
+	// Only execute the enabled queries for the type of fabric, the object model of cloud and on-premises fabrics differ
+	fabricQueries := AllQueries{
+		ClassQueries:         ClassQueries{},
+		CompoundClassQueries: CompoundClassQueries{},
+		GroupClassQueries:    GroupClassQueries{},
+	}
+	for k, v := range executeQueries.ClassQueries {
+		if supportsFabricType(v.FabricTypes, fabricConfig.Type) && isEnabled(v.Enabled) {
+			fabricQueries.ClassQueries[k] = v
+		}
+	}
+	for k, v := range executeQueries.CompoundClassQueries {
+		if supportsFabricType(v.FabricTypes, fabricConfig.Type) && isEnabled(v.Enabled) {
+			fabricQueries.CompoundClassQueries[k] = v
+		}
+	}
+	for k, v := range executeQueries.GroupClassQueries {
+		if supportsFabricType(v.FabricTypes, fabricConfig.Type) && isEnabled(v.Enabled) {
+			fabricQueries.GroupClassQueries[k] = v
+		}
+	}
+	executeQueries = fabricQueries
+
+	// The statistics of the scrape, in the context so the connection can add the bytes received by each query
+	stats := newQueryStats()
+	ctx = context.WithValue(ctx, "querystats", stats)
+
+	connection := *newAciConnction(ctx, fabricConfig)
+
 	api := &aciAPI{
 		ctx:                   ctx,
-		connection:            *newAciConnction(ctx, fabricConfig),
+		connection:            connection,
+		queryer:               connection,
 		metricPrefix:          viper.GetString("prefix"),
 		configQueries:         executeQueries.ClassQueries,
 		configCompoundQueries: executeQueries.CompoundClassQueries,
 		configGroupQueries:    executeQueries.GroupClassQueries,
 		confgBuiltInQueries:   BuilitinQueries{},
+		metricNames:           viper.GetStringMapString("metric_names"),
+		stats:                 stats,
 	}
 
 	// Make sure all built in queries are handled
-	if queryArray[0] != "" {
-		// If query parameter queries is used
-		for _, v := range queryArray {
-			if v == "faults" {
-				api.confgBuiltInQueries["faults"] = api.faults
-			}
-			// Add all other builtin with if statements
+	for name, builtin := range builtInQueries {
+		if queryArray[0] != "" && !contains(queryArray, name) {
+			// If query parameter queries is used, only include the named
+			continue
+		}
+		if !supportsFabricType(builtInFabricTypes[name], fabricConfig.Type) {
+			continue
+		}
+		if !viper.GetBool(fmt.Sprintf("builtin_queries.%s.enabled", name)) {
+			// Disabled built-in queries are not executed at all
+			continue
+		}
+		if name == "endpoint_scale" && fabricConfig.HardwareGeneration == "" {
+			// The max endpoints depend on the hardware of the fabric, so there is no ratio without the generation
+			continue
+		}
+		fun := builtin
+		api.confgBuiltInQueries[name] = func(ch chan []MetricDefinition) {
+			fun(*api, ch)
 		}
-	} else {
-		// If query parameter queries is NOT used, include all
-		api.confgBuiltInQueries["faults"] = api.faults
-		// Add all other builtin
 	}
 
 	return api
 }
 
+// builtInQueries map the name of the built-in queries to the function that execute them
+var builtInQueries = map[string]func(aciAPI, chan []MetricDefinition){
+	"faults":               aciAPI.faults,
+	"faults_by_domain":     aciAPI.faultsByDomain,
+	"faults_by_lifecycle":  aciAPI.faultsByLifecycle,
+	"tenant_faults":        aciAPI.tenantFaults,
+	"encap":                aciAPI.encap,
+	"apic_cluster":         aciAPI.apicCluster,
+	"config_export":        aciAPI.configExport,
+	"dhcp_relay":           aciAPI.dhcpRelay,
+	"access_ports":         aciAPI.accessPorts,
+	"equipment_redundancy": aciAPI.equipmentRedundancy,
+	"active_sessions":      aciAPI.activeSessions,
+	"coop":                 aciAPI.coop,
+	"svi_status":           aciAPI.sviStatus,
+	"endpoint_moves":       aciAPI.endpointMoves,
+	"tep_pool":             aciAPI.tepPool,
+	"config_changes":       aciAPI.configChanges,
+	"node_registration":    aciAPI.nodeRegistration,
+	"mcp":                  aciAPI.mcpLoops,
+	"epg_deployment":       aciAPI.epgDeployment,
+	"fabric_topology":      aciAPI.fabricTopology,
+	"endpoint_scale":       aciAPI.endpointScale,
+	"fault_age":            aciAPI.faultAge,
+	"pod_environment":      aciAPI.podEnvironment,
+	"firmware_upgrade":     aciAPI.firmwareUpgrade,
+	"interface_mtu":        aciAPI.interfaceMtu,
+	"contract_hits":        aciAPI.contractHits,
+	"fabric_drops":         aciAPI.fabricDrops,
+	"bgp_routes":           aciAPI.bgpRoutes,
+	"epg_domains":          aciAPI.epgDomains,
+	"node_time_drift":      aciAPI.nodeTimeDrift,
+	"node_faults":          aciAPI.nodeFaults,
+}
+
+// builtInFabricTypes map the name of the built-in queries that are not only for on-premises fabrics to the fabric
+// types they can be executed on
+var builtInFabricTypes = map[string][]string{
+	"faults":          {FabricTypeOnPrem, FabricTypeCloud},
+	"apic_cluster":    {FabricTypeOnPrem, FabricTypeCloud},
+	"active_sessions": {FabricTypeOnPrem, FabricTypeCloud},
+}
+
+// builtinPath return the gjson path used by a built-in query to extract data from the apic response. The path can be
+// overridden with builtin_queries.<query>.paths.<name> in the configuration, e.g. if an apic version has changed the
+// structure of the response, else the compiled-in path is returned
+func builtinPath(query string, name string, path string) string {
+	if override := viper.GetString(fmt.Sprintf("builtin_queries.%s.paths.%s", query, name)); override != "" {
+		return override
+	}
+	return path
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// queryer is the source of the apic responses the metrics are created from
+type queryer interface {
+	getByQuery(table string) (string, error)
+	getByClassQuery(class string, query string) (string, error)
+	getByDnQuery(dn string, query string) (string, error)
+	getByNodeClassQuery(node string, class string, query string) (string, error)
+}
+
 type aciAPI struct {
 	ctx                   context.Context
 	connection            AciConnection
+	queryer               queryer
 	metricPrefix          string
 	configQueries         ClassQueries
 	configCompoundQueries CompoundClassQueries
 	configGroupQueries    GroupClassQueries
 	confgBuiltInQueries   BuilitinQueries
+	metricNames           map[string]string
+	stats                 *queryStats
 }
 
 // CollectMetrics Gather all aci metrics and return name of the aci fabric, slice of metrics and status of
-// successful login
+// successful login. If the login fail only the exporter own metrics, like up and scrape_duration, are returned
 func (p aciAPI) CollectMetrics() (string, []MetricDefinition, error) {
 	start := time.Now()
 
-	err := p.connection.login()
-	defer p.connection.logout()
-
-	if err != nil {
-		return "", nil, err
+	aciName, logout, err := p.login()
+	if logout {
+		defer p.connection.logout()
 	}
-
-	aciName, err := p.getAciName()
 	if err != nil {
-		return "", nil, err
+		return "", p.failedScrape(start), err
 	}
 
 	// Hold all metrics created during the session
 	var metrics []MetricDefinition
-	ch := make(chan []MetricDefinition)
+	metrics = append(metrics, *p.up(1))
+	if certExpiry := p.tlsCertExpiry(); certExpiry != nil {
+		metrics = append(metrics, *certExpiry)
+	}
+
+	// Each query send its result on the channel. The channel is buffered for all queries, so queries that are still
+	// running when the scrape times out do not block
+	queries := len(p.confgBuiltInQueries) + len(p.configQueries) + len(p.configCompoundQueries) + len(p.configGroupQueries)
+	ch := make(chan []MetricDefinition, queries)
+	p.runQueries(ch)
+
+	// Return the metrics of the queries done before the scrape timeout, the context deadline
+	timedOut := false
+	for i := 0; i < queries && !timedOut; i++ {
+		select {
+		case metricDefinitions := <-ch:
+			metrics = append(metrics, metricDefinitions...)
+		case <-p.ctx.Done():
+			timedOut = true
+			log.WithFields(log.Fields{
+				"requestid": p.ctx.Value("requestid"),
+				"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+			}).Warn(fmt.Sprintf("scrape timed out with %d of %d queries done", i, queries))
+			p.setUnfinished()
+		}
+	}
+	// The metrics of the scrape itself, except up, are only returned if scrape_metrics is set
+	scrapeMetrics := viper.GetBool("scrape_metrics")
+	if scrapeMetrics {
+		metrics = append(metrics, *p.scrapeTimedOut(timedOut))
+	}
+	metrics = p.processMetrics(metrics)
+
+	end := time.Since(start)
+	if scrapeMetrics {
+		metrics = append(metrics, *p.scrape(end.Seconds()))
+		metrics = append(metrics, p.stats.metrics()...)
+	}
+
+	p.renameMetrics(metrics)
+	metrics = p.truncateLabels(metrics, viper.GetInt("label_max_length"))
+	metrics = p.limitCardinality(metrics)
+
+	log.WithFields(log.Fields{
+		"requestid": p.ctx.Value("requestid"),
+		"exec_time": end.Microseconds(),
+		"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+	}).Info("total scrape time ")
+	return aciName, metrics, nil
+}
 
+// runQueries start all queries, each query send its result on the channel
+func (p aciAPI) runQueries(ch chan []MetricDefinition) {
 	// Built-in
-	go p.configuredBuiltInMetrics(ch)
+	p.configuredBuiltInMetrics(ch)
 
 	// Execute all configured class queries
-	go p.configuredClassMetrics(ch)
+	p.configuredClassMetrics(ch)
 
 	// Execute all configured compound queries
-	go p.configuredCompoundsMetrics(ch)
+	p.configuredCompoundsMetrics(ch)
 
 	// Execute all configured group queries
-	go p.configuredGroupMetrics(ch)
+	p.configuredGroupMetrics(ch)
+}
 
-	for i := 0; i < 4; i++ {
-		metrics = append(metrics, <-ch...)
+// login to the fabric and return the name of the fabric. The cached login session of the fabric is used if there is a
+// valid one, else the connection is logged in and logout is true, so the caller logout when done
+func (p aciAPI) login() (aciName string, logout bool, err error) {
+	session, cached := loginSessions[fmt.Sprintf("%v", p.ctx.Value("fabric"))]
+	if cached && session.use(p.connection) {
+		aciName, err = p.getAciName()
+		if err == nil {
+			return aciName, false, nil
+		}
+		// The session may have timed out on the apic
+		session.invalidate()
 	}
 
-	end := time.Since(start)
-	metrics = append(metrics, *p.scrape(end.Seconds()))
+	err = p.connection.login()
+	if err != nil {
+		return "", true, err
+	}
+	aciName, err = p.getAciName()
+	return aciName, true, err
+}
 
-	log.WithFields(log.Fields{
-		"requestid": p.ctx.Value("requestid"),
-		"exec_time": end.Microseconds(),
-		"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
-	}).Info("total scrape time ")
-	return aciName, metrics, nil
+// truncateLabels truncate the label values longer than maxLength, like long descriptions, and end them with ... and a
+// hash of the full value, so the truncation is visible and values with the same beginning stay unique. The length is in
+// characters, not bytes. If maxLength is too short for the hash, the values are only cut, and of the series of a metric
+// that end up with the same labels only the first is kept
+func (p aciAPI) truncateLabels(metrics []MetricDefinition, maxLength int) []MetricDefinition {
+	const marker = "..."
+	const hashLength = 8
+	if maxLength <= 0 {
+		return metrics
+	}
+	for i, metricDefinition := range metrics {
+		truncated := false
+		for _, metric := range metricDefinition.Metrics {
+			for name, value := range metric.Labels {
+				runes := []rune(value)
+				if len(runes) <= maxLength {
+					continue
+				}
+				truncated = true
+				if maxLength <= len(marker)+hashLength {
+					metric.Labels[name] = string(runes[:maxLength])
+					continue
+				}
+				hash := fnv.New32a()
+				hash.Write([]byte(value))
+				metric.Labels[name] = fmt.Sprintf("%s%s%08x", string(runes[:maxLength-len(marker)-hashLength]), marker, hash.Sum32())
+			}
+		}
+		if truncated {
+			metrics[i].Metrics = p.uniqueSeries(metricDefinition)
+		}
+	}
+	return metrics
+}
+
+// uniqueSeries return the series of the metric with unique labels, the first series of the same labels is kept
+func (p aciAPI) uniqueSeries(metricDefinition MetricDefinition) []Metric {
+	seen := make(map[string]bool)
+	var unique []Metric
+	for _, metric := range metricDefinition.Metrics {
+		names := make([]string, 0, len(metric.Labels))
+		for name := range metric.Labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var key strings.Builder
+		for _, name := range names {
+			key.WriteString(strconv.Quote(name))
+			key.WriteString(strconv.Quote(metric.Labels[name]))
+		}
+		if seen[key.String()] {
+			continue
+		}
+		seen[key.String()] = true
+		unique = append(unique, metric)
+	}
+	if dropped := len(metricDefinition.Metrics) - len(unique); dropped > 0 {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Warn(fmt.Sprintf("metric %s has %d series with the same labels after label_max_length truncation, only the first is kept", metricDefinition.Name, dropped))
+	}
+	return unique
+}
+
+// limitCardinality warn about the metrics with more series than cardinality.max_series, and if cardinality.drop is
+// set remove the metrics, so a query on a large fabric, like all endpoints, can not flood Prometheus with series
+func (p aciAPI) limitCardinality(metrics []MetricDefinition) []MetricDefinition {
+	maxSeries := viper.GetInt("cardinality.max_series")
+	if maxSeries <= 0 {
+		return metrics
+	}
+	drop := viper.GetBool("cardinality.drop")
+	fabric := fmt.Sprintf("%v", p.ctx.Value("fabric"))
+
+	var limited []MetricDefinition
+	for _, metricDefinition := range metrics {
+		if len(metricDefinition.Metrics) <= maxSeries {
+			limited = append(limited, metricDefinition)
+			continue
+		}
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fabric,
+		}).Warn(fmt.Sprintf("metric %s has %d series, more than the max %d", metricDefinition.Name, len(metricDefinition.Metrics), maxSeries))
+		if drop {
+			seriesDropped.WithLabelValues(fabric, metricDefinition.Name).Add(float64(len(metricDefinition.Metrics)))
+			continue
+		}
+		limited = append(limited, metricDefinition)
+	}
+	return limited
+}
+
+// setUnfinished set the queries that did not finish before the scrape timeout as not successful
+func (p aciAPI) setUnfinished() {
+	p.stats.setUnfinished(p.queryNames())
+}
+
+// queryNames return the names of all queries of the api, configured and built-in
+func (p aciAPI) queryNames() []string {
+	var names []string
+	for name := range p.configQueries {
+		names = append(names, name)
+	}
+	for name := range p.configCompoundQueries {
+		names = append(names, name)
+	}
+	for name := range p.configGroupQueries {
+		names = append(names, name)
+	}
+	for name := range p.confgBuiltInQueries {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (p aciAPI) scrapeTimedOut(timedOut bool) *MetricDefinition {
+	metricDefinition := MetricDefinition{}
+	metricDefinition.Name = "scrape_timed_out"
+	metricDefinition.Description = MetricDesc{
+		Help: "Returns 1 if the scrape timed out and only the metrics of the queries done before the timeout are returned, else 0",
+		Type: "gauge",
+		Unit: "",
+	}
+	metric := Metric{}
+	metric.Labels = make(map[string]string)
+	if timedOut {
+		metric.Value = 1
+	}
+	metricDefinition.Metrics = []Metric{metric}
+	return &metricDefinition
+}
+
+// failedScrape return the metrics of a scrape where no queries could be executed
+func (p aciAPI) failedScrape(start time.Time) []MetricDefinition {
+	for name := range p.configQueries {
+		p.stats.setSuccess(name, false)
+	}
+	for name := range p.configCompoundQueries {
+		p.stats.setSuccess(name, false)
+	}
+	for name := range p.configGroupQueries {
+		p.stats.setSuccess(name, false)
+	}
+	for name := range p.confgBuiltInQueries {
+		p.stats.setSuccess(name, false)
+	}
+
+	var metrics []MetricDefinition
+	metrics = append(metrics, *p.up(0))
+	if viper.GetBool("scrape_metrics") {
+		metrics = append(metrics, *p.scrape(time.Since(start).Seconds()))
+		metrics = append(metrics, p.stats.metrics()...)
+	}
+	p.renameMetrics(metrics)
+	return metrics
+}
+
+func (p aciAPI) up(value float64) *MetricDefinition {
+	metricDefinition := MetricDefinition{}
+	metricDefinition.Name = "up"
+	metricDefinition.Description = MetricDesc{
+		Help: "Returns 1 if the exporter could login to an apic of the fabric, else 0",
+		Type: "gauge",
+		Unit: "",
+	}
+
+	metric := Metric{}
+	metric.Labels = make(map[string]string)
+	metric.Value = value
+	metricDefinition.Metrics = []Metric{metric}
+
+	return &metricDefinition
 }
 
 func (p aciAPI) scrape(seconds float64) *MetricDefinition {
@@ -166,28 +520,79 @@ func (p aciAPI) scrape(seconds float64) *MetricDefinition {
 	return &metricDefinition
 }
 
-func (p aciAPI) configuredBuiltInMetrics(chall chan []MetricDefinition) {
-	var metricDefinitions []MetricDefinition
-	ch := make(chan []MetricDefinition)
-	for _, fun := range p.confgBuiltInQueries {
-		go fun(ch)
+// renameMetrics rename the metrics according to the metric_names mapping. A rename that would collide with the name
+// of another metric is not done
+func (p aciAPI) renameMetrics(metrics []MetricDefinition) {
+	if len(p.metricNames) == 0 {
+		return
+	}
+
+	names := make(map[string]bool)
+	for _, metricDefinition := range metrics {
+		names[metricDefinition.Name] = true
+	}
+
+	for i, metricDefinition := range metrics {
+		newName, ok := p.metricNames[metricDefinition.Name]
+		if !ok || newName == metricDefinition.Name {
+			continue
+		}
+		if names[newName] {
+			log.WithFields(log.Fields{
+				"requestid": p.ctx.Value("requestid"),
+				"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+			}).Error(fmt.Sprintf("metric %s can not be renamed to %s, name already in use", metricDefinition.Name, newName))
+			continue
+		}
+		names[newName] = true
+		metrics[i].Name = newName
 	}
+}
 
-	for range p.confgBuiltInQueries {
-		metricDefinitions = append(metricDefinitions, <-ch...)
+// withQuery return a copy of the api where the requests to the apic are labeled with the name of the query, for the
+// request duration by query
+func (p aciAPI) withQuery(name string) aciAPI {
+	api := p
+	api.ctx = context.WithValue(p.ctx, "query", name)
+	api.connection.ctx = api.ctx
+	if _, ok := p.queryer.(AciConnection); ok {
+		api.queryer = api.connection
 	}
+	return api
+}
 
-	chall <- metricDefinitions
+func (p aciAPI) configuredBuiltInMetrics(ch chan []MetricDefinition) {
+	for name := range p.confgBuiltInQueries {
+		go func(name string) {
+			// A built-in query return nil if it failed
+			chBuiltIn := make(chan []MetricDefinition)
+			if ttl := viper.GetInt(fmt.Sprintf("builtin_queries.%s.cache_ttl", name)); ttl > 0 {
+				go p.withQuery(name).cachedQuery(chBuiltIn, name, ttl, builtInQueries[name])
+			} else {
+				go builtInQueries[name](p.withQuery(name), chBuiltIn)
+			}
+			metricDefinitions := <-chBuiltIn
+			p.stats.setSuccess(name, metricDefinitions != nil)
+			ch <- metricDefinitions
+		}(name)
+	}
 }
 
 func (p aciAPI) faults(ch chan []MetricDefinition) {
-	data, err := p.connection.getByQuery("faults")
+	// Use the fault state of the fault subscription if enabled for the fabric
+	if subscription, ok := faultSubscriptions[fmt.Sprintf("%v", p.ctx.Value("fabric"))]; ok && subscription.isSynced() {
+		ch <- subscription.metrics()
+		return
+	}
+
+	data, err := p.queryer.getByQuery("faults")
 	if err != nil {
 		log.WithFields(log.Fields{
 			"requestid": p.ctx.Value("requestid"),
 			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
 		}).Error("faults not supported", err)
 		ch <- nil
+		return
 	}
 
 	metricDefinitionFaults := MetricDefinition{}
@@ -198,45 +603,6 @@ func (p aciAPI) faults(ch chan []MetricDefinition) {
 		Unit: "",
 	}
 
-	var metrics []Metric
-	children := gjson.Get(data, "imdata.0.faultCountsWithDetails.children.#.faultTypeCounts")
-
-	children.ForEach(func(key, value gjson.Result) bool {
-
-		metric := Metric{}
-		metric.Labels = make(map[string]string)
-		metric.Labels["type"] = gjson.Get(value.String(), "attributes.type").Str
-		metric.Labels["severity"] = "crit"
-		metric.Value = p.toFloat(gjson.Get(value.String(), "attributes.crit").Str)
-		metrics = append(metrics, metric)
-
-		metric = Metric{}
-		metric.Labels = make(map[string]string)
-		metric.Labels["type"] = gjson.Get(value.String(), "attributes.type").Str
-		metric.Labels["severity"] = "maj"
-		metric.Value = p.toFloat(gjson.Get(value.String(), "attributes.maj").Str)
-		metrics = append(metrics, metric)
-
-		metric = Metric{}
-		metric.Labels = make(map[string]string)
-		metric.Labels["type"] = gjson.Get(value.String(), "attributes.type").Str
-		metric.Labels["severity"] = "minor"
-		metric.Value = p.toFloat(gjson.Get(value.String(), "attributes.minor").Str)
-		metrics = append(metrics, metric)
-
-		metric = Metric{}
-		metric.Labels = make(map[string]string)
-		metric.Labels["type"] = gjson.Get(value.String(), "attributes.type").Str
-		metric.Labels["severity"] = "warn"
-		metric.Value = p.toFloat(gjson.Get(value.String(), "attributes.warn").Str)
-		metrics = append(metrics, metric)
-
-		return true // keep iterating
-	})
-
-	metricDefinitionFaults.Metrics = metrics
-
-	metrics = []Metric{}
 	metricDefinitionAcked := MetricDefinition{}
 	metricDefinitionAcked.Name = "faults_acked"
 	metricDefinitionAcked.Description = MetricDesc{
@@ -245,68 +611,51 @@ func (p aciAPI) faults(ch chan []MetricDefinition) {
 		Unit: "",
 	}
 
-	children.ForEach(func(key, value gjson.Result) bool {
-
-		metric := Metric{}
-		metric.Labels = make(map[string]string)
-		metric.Labels["type"] = gjson.Get(value.String(), "attributes.type").Str
-		metric.Labels["severity"] = "crit"
-		metric.Value = p.toFloat(gjson.Get(value.String(), "attributes.critAcked").Str)
-		metrics = append(metrics, metric)
-
-		metric = Metric{}
-		metric.Labels = make(map[string]string)
-		metric.Labels["type"] = gjson.Get(value.String(), "attributes.type").Str
-		metric.Labels["severity"] = "maj"
-		metric.Value = p.toFloat(gjson.Get(value.String(), "attributes.majAcked").Str)
-		metrics = append(metrics, metric)
-
-		metric = Metric{}
-		metric.Labels = make(map[string]string)
-		metric.Labels["type"] = gjson.Get(value.String(), "attributes.type").Str
-		metric.Labels["severity"] = "minor"
-		metric.Value = p.toFloat(gjson.Get(value.String(), "attributes.minorAcked").Str)
-		metrics = append(metrics, metric)
+	// Only the selected severities, like crit and maj, to limit the number of series
+	severities := viper.GetStringSlice("builtin_queries.faults.severities")
+	children := gjson.Get(data, builtinPath("faults", "fault_counts", "imdata.0.faultCountsWithDetails.children.#.faultTypeCounts"))
 
-		metric = Metric{}
-		metric.Labels = make(map[string]string)
-		metric.Labels["type"] = gjson.Get(value.String(), "attributes.type").Str
-		metric.Labels["severity"] = "warn"
-		metric.Value = p.toFloat(gjson.Get(value.String(), "attributes.warnAcked").Str)
-		metrics = append(metrics, metric)
+	children.ForEach(func(key, value gjson.Result) bool {
+		for _, severity := range severities {
+			metric := Metric{}
+			metric.Labels = make(map[string]string)
+			metric.Labels["type"] = gjson.Get(value.String(), "attributes.type").Str
+			metric.Labels["severity"] = severity
+			metric.Value = p.toFloat(gjson.Get(value.String(), "attributes."+severity).Str)
+			metricDefinitionFaults.Metrics = append(metricDefinitionFaults.Metrics, metric)
 
+			metric = Metric{}
+			metric.Labels = make(map[string]string)
+			metric.Labels["type"] = gjson.Get(value.String(), "attributes.type").Str
+			metric.Labels["severity"] = severity
+			metric.Value = p.toFloat(gjson.Get(value.String(), "attributes."+severity+"Acked").Str)
+			metricDefinitionAcked.Metrics = append(metricDefinitionAcked.Metrics, metric)
+		}
 		return true // keep iterating
 	})
 
-	metricDefinitionAcked.Metrics = metrics
-
 	ch <- []MetricDefinition{metricDefinitionFaults, metricDefinitionAcked}
 }
 
 func (p aciAPI) getAciName() (string, error) {
-	data, err := p.connection.getByQuery("aci_name")
+	data, err := p.queryer.getByQuery("aci_name")
 	if err != nil {
 		return "", err
 	}
 
-	return gjson.Get(data, "imdata.0.infraCont.attributes.fbDmNm").Str, nil
+	return gjson.Get(data, builtinPath("aci_name", "name", "imdata.0.infraCont.attributes.fbDmNm")).Str, nil
 }
 
-func (p aciAPI) configuredCompoundsMetrics(chall chan []MetricDefinition) {
-	var metricDefinitions []MetricDefinition
-	ch := make(chan []MetricDefinition)
-	for _, v := range p.configCompoundQueries {
-		go p.getCompoundMetrics(ch, v)
-	}
-
-	for range p.configCompoundQueries {
-		metricDefinitions = append(metricDefinitions, <-ch...)
+func (p aciAPI) configuredCompoundsMetrics(ch chan []MetricDefinition) {
+	for name, v := range p.configCompoundQueries {
+		name, v := name, v
+		go p.withQuery(name).cachedQuery(ch, name, v.CacheTTL, func(api aciAPI, ch chan []MetricDefinition) {
+			api.getCompoundMetrics(ch, name, v)
+		})
 	}
-
-	chall <- metricDefinitions
 }
 
-func (p aciAPI) getCompoundMetrics(ch chan []MetricDefinition, v *CompoundClassQuery) {
+func (p aciAPI) getCompoundMetrics(ch chan []MetricDefinition, name string, v *CompoundClassQuery) {
 	var metricDefinitions []MetricDefinition
 	metricDefinition := MetricDefinition{}
 	metricDefinition.Name = v.Metrics[0].Name
@@ -317,7 +666,9 @@ func (p aciAPI) getCompoundMetrics(ch chan []MetricDefinition, v *CompoundClassQ
 	var metrics []Metric
 	for _, classlabel := range v.ClassNames {
 		metric := Metric{}
-		data, _ := p.connection.getByClassQuery(classlabel.Class, classlabel.QueryParameter)
+		data, err := p.queryer.getByClassQuery(classlabel.Class, classlabel.QueryParameter)
+		p.stats.setSuccess(name, err == nil)
+		p.stats.addResultCount(name, int(gjson.Get(data, "imdata.#").Int()))
 		if classlabel.ValueName == "" {
 			metric.Value = p.toFloat(gjson.Get(data, fmt.Sprintf("imdata.0.%s", v.Metrics[0].ValueName)).Str)
 		} else {
@@ -332,35 +683,24 @@ func (p aciAPI) getCompoundMetrics(ch chan []MetricDefinition, v *CompoundClassQ
 	ch <- metricDefinitions
 }
 
-func (p aciAPI) configuredGroupMetrics(chall chan []MetricDefinition) {
-	var metricDefinitions []MetricDefinition
-	ch := make(chan []MetricDefinition)
-
-	for _, v := range p.configGroupQueries {
-		go p.getGroupClassMetrics(ch, *v)
+func (p aciAPI) configuredGroupMetrics(ch chan []MetricDefinition) {
+	for name, v := range p.configGroupQueries {
+		name, v := name, v
+		go p.withQuery(name).cachedQuery(ch, name, v.CacheTTL, func(api aciAPI, ch chan []MetricDefinition) {
+			api.getGroupClassMetrics(ch, name, *v)
+		})
 	}
-
-	for range p.configGroupQueries {
-		metricDefinitions = append(metricDefinitions, <-ch...)
-	}
-
-	chall <- metricDefinitions
 }
 
-func (p aciAPI) configuredClassMetrics(chall chan []MetricDefinition) {
-	var metricDefinitions []MetricDefinition
-	ch := make(chan []MetricDefinition)
-	for _, v := range p.configQueries {
-		go p.getClassMetrics(ch, v)
-	}
-
-	for range p.configQueries {
-		metricDefinitions = append(metricDefinitions, <-ch...)
+func (p aciAPI) configuredClassMetrics(ch chan []MetricDefinition) {
+	for name, v := range p.configQueries {
+		name, v := name, v
+		go p.withQuery(name).cachedQuery(ch, name, v.CacheTTL, func(api aciAPI, ch chan []MetricDefinition) {
+			api.getClassMetrics(ch, name, v)
+		})
 	}
-
-	chall <- metricDefinitions
 }
-func (p aciAPI) getGroupClassMetrics(ch chan []MetricDefinition, v GroupClassQuery) {
+func (p aciAPI) getGroupClassMetrics(ch chan []MetricDefinition, name string, v GroupClassQuery) {
 	var metricDefinitions []MetricDefinition
 
 	metricDefinition := MetricDefinition{}
@@ -381,20 +721,31 @@ func (p aciAPI) getGroupClassMetrics(ch chan []MetricDefinition, v GroupClassQue
 
 	chsub := make(chan []MetricDefinition)
 
+	executed := 0
 	for _, query := range v.Queries {
+		if !isEnabled(query.Enabled) {
+			continue
+		}
+		executed++
 		// Need copy by value
 		queryValue := ClassQuery{
 			ClassName:      query.ClassName,
+			Dn:             query.Dn,
 			QueryParameter: query.QueryParameter,
 			Metrics:        query.Metrics,
 			Labels:         query.Labels,
 			StaticLabels:   query.StaticLabels,
+			DnLabel:        query.DnLabel,
+			HealthStatus:   query.HealthStatus,
+			PageSize:       query.PageSize,
+			Sample:         query.Sample,
+			MaxSeries:      query.MaxSeries,
 		}
 
-		go p.getClassMetrics(chsub, &queryValue)
+		go p.getClassMetrics(chsub, name, &queryValue)
 	}
 
-	for range v.Queries {
+	for i := 0; i < executed; i++ {
 		md := <-chsub
 		for _, vx := range md {
 			for _, vy := range vx.Metrics {
@@ -411,20 +762,38 @@ func (p aciAPI) getGroupClassMetrics(ch chan []MetricDefinition, v GroupClassQue
 	ch <- metricDefinitions
 }
 
-func (p aciAPI) getClassMetrics(ch chan []MetricDefinition, v *ClassQuery) {
+func (p aciAPI) getClassMetrics(ch chan []MetricDefinition, name string, v *ClassQuery) {
 
 	var metricDefinitions []MetricDefinition
-	data, err := p.connection.getByClassQuery(v.ClassName, v.QueryParameter)
+	var data string
+	var err error
+	queryTarget := v.ClassName
+	if v.Dn != "" {
+		// Query a specific managed object instead of all objects of the class
+		queryTarget = v.Dn
+		data, err = getPages(v.PageSize, v.QueryParameter, func(query string) (string, error) {
+			return p.queryer.getByDnQuery(v.Dn, query)
+		})
+	} else {
+		data, err = getPages(v.PageSize, v.QueryParameter, func(query string) (string, error) {
+			return p.queryer.getByClassQuery(v.ClassName, query)
+		})
+	}
 
 	if err != nil {
 		log.WithFields(log.Fields{
 			"requestid": p.ctx.Value("requestid"),
 			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
-		}).Error(fmt.Sprintf("%s not supported", v.ClassName), err)
+		}).Error(fmt.Sprintf("%s not supported", queryTarget), err)
+		p.stats.setSuccess(name, false)
 		ch <- nil
+		return
 	}
+	p.stats.setSuccess(name, true)
+	p.stats.addResultCount(name, int(gjson.Get(data, "imdata.#").Int()))
 
 	// For each metrics in the config
+	dropped := 0
 	for _, mv := range v.Metrics {
 		metricDefinition := MetricDefinition{}
 		metricDefinition.Name = mv.Name
@@ -436,13 +805,64 @@ func (p aciAPI) getClassMetrics(ch chan []MetricDefinition, v *ClassQuery) {
 
 		metrics = p.extractClassQueriesData(data, v, mv, metrics)
 
-		metricDefinition.Metrics = metrics
+		var droppedSeries int
+		metricDefinition.Metrics, droppedSeries = sampleSeries(metrics, v.Sample, v.MaxSeries)
+		dropped += droppedSeries
 
 		metricDefinitions = append(metricDefinitions, metricDefinition)
 	}
+	if v.Sample > 1 || v.MaxSeries > 0 {
+		p.stats.addSeriesDropped(name, dropped)
+	}
 	ch <- metricDefinitions
 }
 
+// sampleSeries return every sample:th series, at most maxSeries of them, and the number of series dropped. It is used
+// to try out queries that may return a very large number of series
+func sampleSeries(metrics []Metric, sample int, maxSeries int) ([]Metric, int) {
+	if sample <= 1 && maxSeries <= 0 {
+		return metrics, 0
+	}
+	var sampled []Metric
+	for i, metric := range metrics {
+		if sample > 1 && i%sample != 0 {
+			continue
+		}
+		if maxSeries > 0 && len(sampled) >= maxSeries {
+			break
+		}
+		sampled = append(sampled, metric)
+	}
+	return sampled, len(metrics) - len(sampled)
+}
+
+// getPages do the query in pages of pageSize objects, with the page and page-size query parameters, and return the
+// objects of all pages as a single response. The pages are requested until a page is not full or all objects of the
+// totalCount of the response are received. A pageSize of 0 is a single request without paging
+func getPages(pageSize int, query string, get func(query string) (string, error)) (string, error) {
+	if pageSize <= 0 {
+		return get(query)
+	}
+	var objects []string
+	for page := 0; ; page++ {
+		data, err := get(addQueryParameter(query, fmt.Sprintf("page=%d&page-size=%d", page, pageSize)))
+		if err != nil {
+			return "", err
+		}
+		count := 0
+		gjson.Get(data, "imdata").ForEach(func(key, value gjson.Result) bool {
+			objects = append(objects, value.Raw)
+			count++
+			return true
+		})
+		totalCount := gjson.Get(data, "totalCount")
+		if count < pageSize || (totalCount.Exists() && len(objects) >= int(totalCount.Int())) {
+			break
+		}
+	}
+	return fmt.Sprintf("{\"totalCount\":\"%d\",\"imdata\":[%s]}", len(objects), strings.Join(objects, ",")), nil
+}
+
 func (p aciAPI) extractClassQueriesData(data string, classQuery *ClassQuery, mv ConfigMetric, metrics []Metric) []Metric {
 	result := gjson.Get(data, "imdata")
 
@@ -458,77 +878,61 @@ func (p aciAPI) extractClassQueriesData(data string, classQuery *ClassQuery, mv
 			// 2: the child_name between []
 			// 3: stage2 - the rest after ].
 
-			var allChildren []map[string]interface{}
-
-			allChildrenJson := gjson.Get(value.Raw, match[1])
-			json.Unmarshal([]byte(allChildrenJson.Raw), &allChildren)
-
-			for childIndex, child := range allChildren {
-				for childKey, childValue := range child {
-					// add a check if the childKey match the regexp of match[2]
-					re := regexpcache.MustCompile(match[2])
-
-					_, ok := childValue.(map[string]interface{})
-					if ok && re.Match([]byte(childKey)) {
-						metric := Metric{}
-						metric.Labels = make(map[string]string)
-
-						mvLocal := ConfigMetric{
-							Name:             mv.Name,
-							ValueName:        childKey + match[3],
-							ValueCalculation: mv.ValueCalculation,
-							Unit:             mv.Unit,
-							Type:             mv.Type,
-							Help:             mv.Help,
-							ValueTransform:   mv.ValueTransform,
-						}
+			for _, child := range findChildren(value.Raw, match[1], match[2]) {
+				childKey := child.class
 
-						// Add all high level labels
-						addLabels(classQuery.Labels, classQuery.StaticLabels, value.String(), metric)
-
-						// Add all [*] labels that will be relative to the child key
-						// Rewrite them from the relative path and add them as Config labels
-						var childLabels []ConfigLabels
-						for _, configLabel := range classQuery.Labels {
-							matchLabels := arrayExtension.FindStringSubmatch(configLabel.PropertyName)
-
-							//if len(matchLabels)  >0 && matchLabels[2] == "*" {
-							if len(matchLabels) > 0 && re.Match([]byte(childKey)) {
-								re := regexpcache.MustCompile(matchLabels[2])
-								if re.Match([]byte(childKey)) {
-									localLabel := ConfigLabels{}
-									localLabel.PropertyName = childKey + matchLabels[3]
-									localLabel.Regex = configLabel.Regex
-									childLabels = append(childLabels, localLabel)
-								}
-							}
-						}
+				metric := Metric{}
+				metric.Labels = make(map[string]string)
+
+				mvLocal := ConfigMetric{
+					Name:             mv.Name,
+					ValueName:        childKey + match[3],
+					ValueCalculation: mv.ValueCalculation,
+					Unit:             mv.Unit,
+					Type:             mv.Type,
+					Help:             mv.Help,
+					ValueTransform:   mv.ValueTransform,
+				}
 
-						childJson, _ := json.Marshal(allChildren[childIndex])
-						addLabels(childLabels, nil, string(childJson), metric)
-
-						// Extract labels from child
-						for _, keyLabel := range childLabels {
-							if keyLabel.PropertyName == childKey {
-								re := regexpcache.MustCompile(keyLabel.Regex)
-								match := re.FindStringSubmatch(childKey)
-								if len(match) != 0 {
-									for i, expName := range re.SubexpNames() {
-										if i != 0 && expName != "" {
-											metric.Labels[expName] = match[i]
-										}
-									}
-								}
-							}
+				// Add all high level labels
+				addLabels(classQuery.Labels, classQuery.StaticLabels, value.String(), metric)
+				addDnLabel(classQuery, value.Raw, metric)
+
+				// Add all [*] labels that will be relative to the child key
+				// Rewrite them from the relative path and add them as Config labels
+				var childLabels []ConfigLabels
+				for _, configLabel := range classQuery.Labels {
+					matchLabels := arrayExtension.FindStringSubmatch(configLabel.PropertyName)
+
+					if len(matchLabels) > 0 {
+						re := regexpcache.MustCompile(matchLabels[2])
+						if re.Match([]byte(childKey)) {
+							localLabel := ConfigLabels{}
+							localLabel.PropertyName = childKey + matchLabels[3]
+							localLabel.Regex = configLabel.Regex
+							childLabels = append(childLabels, localLabel)
 						}
+					}
+				}
 
-						// extract the metrics value
-						metric.Value = p.toFloatTransform(gjson.Get(string(childJson), mvLocal.ValueName).Str, mvLocal)
-						valueReCalculation(mv, &metric)
+				childJson := child.json
+				addLabels(childLabels, nil, childJson, metric)
 
-						metrics = append(metrics, metric)
+				// Extract labels from child
+				for _, keyLabel := range childLabels {
+					if keyLabel.PropertyName == childKey {
+						for k, v := range parseLabels(childKey, keyLabel.Regex) {
+							metric.Labels[k] = v
+						}
 					}
 				}
+
+				// extract the metrics value
+				metric.Value = p.toFloatTransform(gjson.Get(childJson, mvLocal.ValueName).Str, mvLocal)
+				addHealthStatus(classQuery, metric)
+				valueReCalculation(mv, &metric)
+
+				metrics = append(metrics, metric)
 			}
 		} else {
 			// Just plain Gjson without any [] expressions
@@ -537,9 +941,11 @@ func (p aciAPI) extractClassQueriesData(data string, classQuery *ClassQuery, mv
 			// find and parse all labels
 			metric.Labels = make(map[string]string)
 			addLabels(classQuery.Labels, classQuery.StaticLabels, value.String(), metric)
+			addDnLabel(classQuery, value.Raw, metric)
 
 			// get the merics value
 			metric.Value = p.toFloatTransform(gjson.Get(value.String(), mv.ValueName).Str, mv)
+			addHealthStatus(classQuery, metric)
 
 			// Post calculation on the value
 			valueReCalculation(mv, &metric)
@@ -558,20 +964,52 @@ func valueReCalculation(mv ConfigMetric, metric *Metric) {
 		parameters := make(map[string]interface{}, 8)
 		parameters["value"] = metric.Value //p.toFloat(gjson.Get(value.String(), mv.ValueName).Str)
 		result, _ := expression.Evaluate(parameters)
-		metric.Value = result.(float64)
+		metric.Value = roundPrecision(result.(float64))
+	}
+}
+
+// roundPrecision round the value to the number of decimals configured by precision. If precision is not set, or
+// negative, the value is not rounded
+func roundPrecision(value float64) float64 {
+	precision := viper.GetInt("precision")
+	if precision < 0 {
+		return value
+	}
+	scale := math.Pow(10, float64(precision))
+	return math.Round(value*scale) / scale
+}
+
+// addDnLabel add the dn of the object as the label dn, if enabled by dn_label on the query
+func addDnLabel(classQuery *ClassQuery, json string, metric Metric) {
+	if !classQuery.DnLabel {
+		return
+	}
+	if dn := gjson.Get(json, "*.attributes.dn").Str; dn != "" {
+		metric.Labels["dn"] = dn
+	}
+}
+
+// addHealthStatus add the label status from the health score, the value before any value_calculation, if enabled by
+// health_status on the query. The score is healthy from health_thresholds.healthy, degraded from
+// health_thresholds.degraded and critical below
+func addHealthStatus(classQuery *ClassQuery, metric Metric) {
+	if !classQuery.HealthStatus {
+		return
+	}
+	switch {
+	case metric.Value >= viper.GetFloat64("health_thresholds.healthy"):
+		metric.Labels["status"] = "healthy"
+	case metric.Value >= viper.GetFloat64("health_thresholds.degraded"):
+		metric.Labels["status"] = "degraded"
+	default:
+		metric.Labels["status"] = "critical"
 	}
 }
 
 func addLabels(v []ConfigLabels, sv []StaticLabels, json string, metric Metric) {
 	for _, lv := range v {
-		re := regexpcache.MustCompile(lv.Regex)
-		match := re.FindStringSubmatch(gjson.Get(json, lv.PropertyName).Str)
-		if len(match) != 0 {
-			for i, expName := range re.SubexpNames() {
-				if i != 0 && expName != "" {
-					metric.Labels[expName] = match[i]
-				}
-			}
+		for k, v := range parseLabels(propertyValue(json, lv.PropertyName), lv.Regex) {
+			metric.Labels[k] = v
 		}
 	}
 	// Add static labels
@@ -580,6 +1018,67 @@ func addLabels(v []ConfigLabels, sv []StaticLabels, json string, metric Metric)
 	}
 }
 
+// propertyValue return the value of the property of the object. A property of a child, like
+// fvTenant.children.[healthInst].attributes.twScore, is the property of the first child of the class, independent of
+// the position of the child in the children
+func propertyValue(json string, property string) string {
+	match := arrayExtension.FindStringSubmatch(property)
+	if len(match) > 0 && strings.HasSuffix(match[1], ".children") {
+		return findChildAttr(json, match[2], strings.TrimPrefix(match[3], "."))
+	}
+	return gjson.Get(json, property).Str
+}
+
+// parseLabels return the labels from a value, typical a dn, where the label names and values are the named capture
+// groups of the regex. If the regex do not match no labels are returned
+func parseLabels(value string, regex string) map[string]string {
+	labels := make(map[string]string)
+	re := regexpcache.MustCompile(regex)
+	match := re.FindStringSubmatch(value)
+	if len(match) != 0 {
+		for i, expName := range re.SubexpNames() {
+			if i != 0 && expName != "" {
+				labels[expName] = match[i]
+			}
+		}
+	}
+	return labels
+}
+
+// childObject is a child of a managed object, where class is the class name of the child and json the raw json of the
+// child including the class name key
+type childObject struct {
+	class string
+	json  string
+}
+
+// findChildren return all children, in the array found at path, which class name match the classRegex. The children
+// are returned in the order of the array, so the lookup do not depend on the position of the child, like children.0
+func findChildren(data string, path string, classRegex string) []childObject {
+	var children []childObject
+	re := regexpcache.MustCompile(classRegex)
+	gjson.Get(data, path).ForEach(func(_, child gjson.Result) bool {
+		child.ForEach(func(class, object gjson.Result) bool {
+			if object.IsObject() && re.MatchString(class.Str) {
+				children = append(children, childObject{class: class.Str, json: child.Raw})
+			}
+			return true
+		})
+		return true
+	})
+	return children
+}
+
+// findChildAttr return the attribute, like attributes.cur, of the first child of the managed object which class name
+// match the classRegex, like healthInst. The children are scanned, so the child can be at any position
+func findChildAttr(value string, classRegex string, attr string) string {
+	children := findChildren(value, "*.children", classRegex)
+	if len(children) == 0 {
+		return ""
+	}
+	return gjson.Get(children[0].json, children[0].class+"."+attr).Str
+}
+
 func dumpMap(space string, m map[string]interface{}) {
 	for k, v := range m {
 		if mv, ok := v.(map[string]interface{}); ok {
@@ -594,7 +1093,7 @@ func dumpMap(space string, m map[string]interface{}) {
 
 func (p aciAPI) toRatio(value string) float64 {
 	rate, _ := strconv.ParseFloat(value, 64)
-	return rate / 100.0
+	return roundPrecision(rate / 100.0)
 }
 
 func (p aciAPI) toFloat(value string) float64 {
@@ -611,7 +1110,7 @@ func (p aciAPI) toFloat(value string) float64 {
 		}
 
 	}
-	return rate
+	return roundPrecision(rate)
 }
 
 func (p aciAPI) toFloatTransform(value string, mv ConfigMetric) float64 {
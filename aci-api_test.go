@@ -0,0 +1,694 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+// Copyright 2020 Opsdis AB
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestFaults(t *testing.T) {
+	tests := []struct {
+		name      string
+		responses map[string]string
+		faults    map[string]float64
+		acked     map[string]float64
+	}{
+		{
+			name: "counts by type and severity",
+			responses: map[string]string{
+				"/api/class/faultCountsWithDetails.json": `{"imdata":[{"faultCountsWithDetails":{"attributes":{},"children":[
+					{"faultTypeCounts":{"attributes":{"type":"config","crit":"2","critAcked":"1","maj":"0","majAcked":"0","minor":"5","minorAcked":"0","warn":"1","warnAcked":"1"}}},
+					{"faultTypeCounts":{"attributes":{"type":"operational","crit":"0","critAcked":"0","maj":"3","majAcked":"2","minor":"0","minorAcked":"0","warn":"0","warnAcked":"0"}}}]}}]}`,
+			},
+			faults: map[string]float64{
+				"severity=crit,type=config":       2,
+				"severity=maj,type=config":        0,
+				"severity=minor,type=config":      5,
+				"severity=warn,type=config":       1,
+				"severity=crit,type=operational":  0,
+				"severity=maj,type=operational":   3,
+				"severity=minor,type=operational": 0,
+				"severity=warn,type=operational":  0,
+			},
+			acked: map[string]float64{
+				"severity=crit,type=config":       1,
+				"severity=maj,type=config":        0,
+				"severity=minor,type=config":      0,
+				"severity=warn,type=config":       1,
+				"severity=crit,type=operational":  0,
+				"severity=maj,type=operational":   2,
+				"severity=minor,type=operational": 0,
+				"severity=warn,type=operational":  0,
+			},
+		},
+		{
+			name:      "no fault types",
+			responses: map[string]string{"/api/class/faultCountsWithDetails.json": `{"imdata":[]}`},
+			faults:    map[string]float64{},
+			acked:     map[string]float64{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			metrics := runQuery(newFixtureAPI(test.responses), aciAPI.faults)
+			if metrics == nil {
+				t.Fatal("faults failed")
+			}
+			assertSeries(t, metrics, "faults", test.faults)
+			assertSeries(t, metrics, "faults_acked", test.acked)
+		})
+	}
+}
+
+func TestFaultsFailed(t *testing.T) {
+	if metrics := runQuery(newFixtureAPI(nil), aciAPI.faults); metrics != nil {
+		t.Errorf("got %v, expected nil when the request failed", metrics)
+	}
+}
+
+func TestGetClassMetrics(t *testing.T) {
+	health := func(podid string, cur string) string {
+		return `{"fabricHealthTotal":{"attributes":{"dn":"topology/pod-` + podid + `/health","cur":"` + cur + `"}}}`
+	}
+	healthQuery := func() ClassQuery {
+		return ClassQuery{
+			ClassName:      "fabricHealthTotal",
+			QueryParameter: `?query-target-filter=wcard(fabricHealthTotal.dn,"topology/.*/health")`,
+			Metrics: []ConfigMetric{{
+				Name:             "fabric_health",
+				ValueName:        "fabricHealthTotal.attributes.cur",
+				ValueCalculation: "value / 100",
+				Type:             "gauge",
+			}},
+			Labels: []ConfigLabels{{
+				PropertyName: "fabricHealthTotal.attributes.dn",
+				Regex:        "^topology/pod-(?P<podid>[1-9][0-9]*)/health",
+			}},
+		}
+	}
+	filter := `/api/class/fabricHealthTotal.json?query-target-filter=wcard(fabricHealthTotal.dn,"topology/.*/health")`
+
+	tests := []struct {
+		name      string
+		query     func() ClassQuery
+		responses map[string]string
+		metric    string
+		expected  map[string]float64
+		count     int
+	}{
+		{
+			name:  "filtered query",
+			query: healthQuery,
+			responses: map[string]string{
+				filter:                              `{"totalCount":"2","imdata":[` + health("1", "95") + `,` + health("2", "80") + `]}`,
+				"/api/class/fabricHealthTotal.json": `{"totalCount":"1","imdata":[` + health("9", "10") + `]}`,
+			},
+			metric:   "fabric_health",
+			expected: map[string]float64{"podid=1": 0.95, "podid=2": 0.8},
+			count:    2,
+		},
+		{
+			name: "paged query",
+			query: func() ClassQuery {
+				q := healthQuery()
+				q.PageSize = 2
+				return q
+			},
+			responses: map[string]string{
+				filter + "&page=0&page-size=2": `{"totalCount":"3","imdata":[` + health("1", "95") + `,` + health("2", "80") + `]}`,
+				filter + "&page=1&page-size=2": `{"totalCount":"3","imdata":[` + health("3", "70") + `]}`,
+				filter:                         `{"totalCount":"1","imdata":[` + health("9", "10") + `]}`,
+			},
+			metric:   "fabric_health",
+			expected: map[string]float64{"podid=1": 0.95, "podid=2": 0.8, "podid=3": 0.7},
+			count:    3,
+		},
+		{
+			name: "count only query",
+			query: func() ClassQuery {
+				return ClassQuery{
+					ClassName: "fvBD",
+					CountOnly: true,
+					Metrics:   []ConfigMetric{{Name: "bridge_domains", Type: "gauge"}},
+				}
+			},
+			responses: map[string]string{
+				"/api/class/fvBD.json?rsp-subtree-include=count": `{"totalCount":"1","imdata":[{"moCount":{"attributes":{"count":"42"}}}]}`,
+				"/api/class/fvBD.json":                           `{"totalCount":"1","imdata":[{"fvBD":{"attributes":{"name":"bd1"}}}]}`,
+			},
+			metric:   "bridge_domains",
+			expected: map[string]float64{"": 42},
+			count:    1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query := test.query()
+			queries := AllQueries{ClassQueries: ClassQueries{test.name: &query}}
+			if err := queries.validate(); err != nil {
+				t.Fatal(err)
+			}
+			api := newFixtureAPI(test.responses)
+			metrics := runQuery(api, func(api aciAPI, ch chan []MetricDefinition) {
+				api.getClassMetrics(ch, test.name, &query)
+			})
+			if metrics == nil {
+				t.Fatal("query failed")
+			}
+			assertSeries(t, metrics, test.metric, test.expected)
+			if count := api.stats.resultCount[test.name]; count != test.count {
+				t.Errorf("got result count %d, expected %d", count, test.count)
+			}
+		})
+	}
+}
+
+func TestGetClassMetricsFailed(t *testing.T) {
+	query := ClassQuery{ClassName: "fvBD", Metrics: []ConfigMetric{{Name: "bridge_domains", Type: "gauge"}}}
+	api := newFixtureAPI(nil)
+	metrics := runQuery(api, func(api aciAPI, ch chan []MetricDefinition) {
+		api.getClassMetrics(ch, "bridge_domains", &query)
+	})
+	if metrics != nil {
+		t.Errorf("got %v, expected nil when the request failed", metrics)
+	}
+	if success := api.stats.success["bridge_domains"]; success {
+		t.Error("got query success, expected failed")
+	}
+}
+
+func TestFindChildAttr(t *testing.T) {
+	health := `{"healthInst":{"attributes":{"cur":"93","maxSev":"minor"}}}`
+	fault := `{"faultDelegate":{"attributes":{"code":"F0467"}}}`
+	tag := `{"tagAliasInst":{"attributes":{"name":"web"}}}`
+	epg := func(children ...string) string {
+		return `{"fvAEPg":{"attributes":{"dn":"uni/tn-a/ap-b/epg-c"},"children":[` + strings.Join(children, ",") + `]}}`
+	}
+
+	tests := []struct {
+		name     string
+		value    string
+		expected string
+	}{
+		{name: "only child", value: epg(health), expected: "93"},
+		{name: "first child", value: epg(health, fault, tag), expected: "93"},
+		{name: "last child", value: epg(fault, tag, health), expected: "93"},
+		{name: "between other children", value: epg(fault, health, tag), expected: "93"},
+		{name: "missing", value: epg(fault, tag), expected: ""},
+		{name: "no children", value: `{"fvAEPg":{"attributes":{"dn":"uni/tn-a/ap-b/epg-c"}}}`, expected: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if actual := findChildAttr(test.value, "healthInst", "attributes.cur"); actual != test.expected {
+				t.Errorf("got %q, expected %q", actual, test.expected)
+			}
+		})
+	}
+}
+
+func TestApicCluster(t *testing.T) {
+	node := func(name string, mode string, health string, operSt string) string {
+		return `{"infraWiNode":{"attributes":{"nodeName":"` + name + `","apicMode":"` + mode + `","health":"` + health +
+			`","operSt":"` + operSt + `"}}}`
+	}
+	// The same request as the infra_node_info query of the example configuration
+	path := `/api/class/infraWiNode.json?query-target-filter=ne(infraWiNode.apicMode,"standby")`
+
+	tests := []struct {
+		name     string
+		nodes    []string
+		expected map[string]float64
+	}{
+		{
+			name:     "fully fit",
+			nodes:    []string{node("apic1", "active", "fully-fit", "available"), node("apic2", "active", "fully-fit", "available")},
+			expected: map[string]float64{"": 1},
+		},
+		{
+			name:     "diverged",
+			nodes:    []string{node("apic1", "active", "fully-fit", "available"), node("apic2", "active", "data-layer-partially-diverged", "available")},
+			expected: map[string]float64{"": 0},
+		},
+		{
+			name:     "unavailable",
+			nodes:    []string{node("apic1", "active", "fully-fit", "available"), node("apic2", "active", "fully-fit", "unavailable")},
+			expected: map[string]float64{"": 0},
+		},
+		{
+			name:     "no controllers",
+			expected: map[string]float64{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newFixtureAPI(map[string]string{path: `{"imdata":[` + strings.Join(test.nodes, ",") + `]}`})
+			metrics := runQuery(api, aciAPI.apicCluster)
+			if metrics == nil {
+				t.Fatal("apic_cluster failed")
+			}
+			assertSeries(t, metrics, "apic_cluster_fully_fit", test.expected)
+		})
+	}
+}
+
+// fabricNodes is the fabric nodes of the tests, an apic, two leafs and two spines
+const fabricNodes = `{"imdata":[` +
+	`{"fabricNode":{"attributes":{"dn":"topology/pod-1/node-1","id":"1","role":"controller","fabricSt":"unknown"}}},` +
+	`{"fabricNode":{"attributes":{"dn":"topology/pod-1/node-101","id":"101","role":"leaf","fabricSt":"active"}}},` +
+	`{"fabricNode":{"attributes":{"dn":"topology/pod-1/node-102","id":"102","role":"leaf","fabricSt":"inactive"}}},` +
+	`{"fabricNode":{"attributes":{"dn":"topology/pod-2/node-201","id":"201","role":"spine","fabricSt":"active"}}},` +
+	`{"fabricNode":{"attributes":{"dn":"topology/pod-2/node-202","id":"202","role":"spine","fabricSt":"active"}}}]}`
+
+func TestNodeFaults(t *testing.T) {
+	fault := func(dn string, severity string) string {
+		return `{"faultInst":{"attributes":{"dn":"` + dn + `","severity":"` + severity + `"}}}`
+	}
+	path := `/api/class/faultInst.json?query-target-filter=wcard(faultInst.dn,"^topology/pod-")`
+	faults := `{"imdata":[` + strings.Join([]string{
+		fault("topology/pod-1/node-101/sys/phys-[eth1/1]/fault-F1678", "critical"),
+		fault("topology/pod-1/node-101/sys/fault-F1360", "major"),
+		fault("topology/pod-1/node-101/sys/fault-F0321", "major"),
+		fault("topology/pod-2/node-201/sys/fault-F0467", "warning"),
+		fault("topology/pod-2/node-202/sys/fault-F1394", "cleared"),
+		fault("topology/pod-1/lnkcnt-1/fault-F0103", "minor"),
+		fault("topology/pod-1/node-1/sys/fault-F0110", "minor"),
+	}, ",") + `]}`
+	responses := map[string]string{path: faults, "/api/class/fabricNode.json": fabricNodes}
+
+	tests := []struct {
+		name               string
+		severities         []string
+		includeControllers bool
+		expected           map[string]float64
+	}{
+		{
+			name:       "default severities",
+			severities: []string{"crit", "maj", "minor", "warn"},
+			expected: map[string]float64{
+				"nodeid=101,podid=1,severity=crit":  1,
+				"nodeid=101,podid=1,severity=maj":   2,
+				"nodeid=101,podid=1,severity=minor": 0,
+				"nodeid=101,podid=1,severity=warn":  0,
+				"nodeid=201,podid=2,severity=crit":  0,
+				"nodeid=201,podid=2,severity=maj":   0,
+				"nodeid=201,podid=2,severity=minor": 0,
+				"nodeid=201,podid=2,severity=warn":  1,
+				"nodeid=202,podid=2,severity=crit":  0,
+				"nodeid=202,podid=2,severity=maj":   0,
+				"nodeid=202,podid=2,severity=minor": 0,
+				"nodeid=202,podid=2,severity=warn":  0,
+			},
+		},
+		{
+			name:       "selected severities",
+			severities: []string{"crit", "maj"},
+			expected: map[string]float64{
+				"nodeid=101,podid=1,severity=crit": 1,
+				"nodeid=101,podid=1,severity=maj":  2,
+				"nodeid=201,podid=2,severity=crit": 0,
+				"nodeid=201,podid=2,severity=maj":  0,
+				"nodeid=202,podid=2,severity=crit": 0,
+				"nodeid=202,podid=2,severity=maj":  0,
+			},
+		},
+		{
+			name:               "with controllers",
+			severities:         []string{"crit", "minor"},
+			includeControllers: true,
+			expected: map[string]float64{
+				"nodeid=1,podid=1,severity=crit":    0,
+				"nodeid=1,podid=1,severity=minor":   1,
+				"nodeid=101,podid=1,severity=crit":  1,
+				"nodeid=101,podid=1,severity=minor": 0,
+				"nodeid=201,podid=2,severity=crit":  0,
+				"nodeid=201,podid=2,severity=minor": 0,
+				"nodeid=202,podid=2,severity=crit":  0,
+				"nodeid=202,podid=2,severity=minor": 0,
+			},
+		},
+	}
+
+	defaultSeverities := viper.GetStringSlice("builtin_queries.faults.severities")
+	defer viper.Set("builtin_queries.faults.severities", defaultSeverities)
+	defer viper.Set("include_controllers", viper.GetBool("include_controllers"))
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			viper.Set("builtin_queries.faults.severities", test.severities)
+			viper.Set("include_controllers", test.includeControllers)
+			metrics := runQuery(newFixtureAPI(responses), aciAPI.nodeFaults)
+			if metrics == nil {
+				t.Fatal("node_faults failed")
+			}
+			assertSeries(t, metrics, "node_fault_count", test.expected)
+		})
+	}
+}
+
+func TestNodeTimeDrift(t *testing.T) {
+	node := func(nodeid string, role string, currentTime string) string {
+		return `{"topSystem":{"attributes":{"dn":"topology/pod-1/node-` + nodeid + `/sys","role":"` + role +
+			`","currentTime":"` + currentTime + `"}}}`
+	}
+	nodes := `{"imdata":[` + strings.Join([]string{
+		node("2", "controller", "2024-05-01T10:00:01.000+00:00"),
+		node("1", "controller", "2024-05-01T10:00:00.000+00:00"),
+		node("101", "leaf", "2024-05-01T10:00:01.500+00:00"),
+		node("201", "spine", "2024-05-01T09:59:59.000+00:00"),
+	}, ",") + `]}`
+
+	tests := []struct {
+		name               string
+		includeControllers bool
+		expected           map[string]float64
+	}{
+		{
+			name: "without controllers",
+			expected: map[string]float64{
+				"nodeid=101,podid=1": 1.5,
+				"nodeid=201,podid=1": -1,
+			},
+		},
+		{
+			name:               "with controllers",
+			includeControllers: true,
+			expected: map[string]float64{
+				"nodeid=1,podid=1":   0,
+				"nodeid=2,podid=1":   1,
+				"nodeid=101,podid=1": 1.5,
+				"nodeid=201,podid=1": -1,
+			},
+		},
+	}
+
+	defer viper.Set("include_controllers", viper.GetBool("include_controllers"))
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			viper.Set("include_controllers", test.includeControllers)
+			metrics := runQuery(newFixtureAPI(map[string]string{"/api/class/topSystem.json": nodes}), aciAPI.nodeTimeDrift)
+			if metrics == nil {
+				t.Fatal("node_time_drift failed")
+			}
+			assertSeries(t, metrics, "node_time_drift", test.expected)
+		})
+	}
+}
+
+func TestEquipmentRedundancy(t *testing.T) {
+	unit := func(class string, dn string, operSt string) string {
+		return `{"` + class + `":{"attributes":{"dn":"` + dn + `","operSt":"` + operSt + `"}}}`
+	}
+	psus := `{"imdata":[` + strings.Join([]string{
+		unit("eqptPsu", "topology/pod-1/node-1/sys/ch/psuslot-1/psu", "ok"),
+		unit("eqptPsu", "topology/pod-1/node-1/sys/ch/psuslot-2/psu", "fail"),
+		unit("eqptPsu", "topology/pod-1/node-101/sys/ch/psuslot-1/psu", "ok"),
+		unit("eqptPsu", "topology/pod-1/node-101/sys/ch/psuslot-2/psu", "ok"),
+		unit("eqptPsu", "topology/pod-2/node-201/sys/ch/psuslot-1/psu", "ok"),
+		unit("eqptPsu", "topology/pod-2/node-201/sys/ch/psuslot-2/psu", "absent"),
+		unit("eqptPsu", "topology/pod-2/node-201/sys/ch/psuslot-3/psu", "shut"),
+	}, ",") + `]}`
+	fans := `{"imdata":[` + strings.Join([]string{
+		unit("eqptFt", "topology/pod-1/node-1/sys/ch/ftslot-1/ft", "ok"),
+		unit("eqptFt", "topology/pod-1/node-101/sys/ch/ftslot-1/ft", "ok"),
+		unit("eqptFt", "topology/pod-1/node-101/sys/ch/ftslot-2/ft", "ok"),
+		unit("eqptFt", "topology/pod-2/node-201/sys/ch/ftslot-1/ft", "fail"),
+	}, ",") + `]}`
+	responses := map[string]string{
+		"/api/class/eqptPsu.json":    psus,
+		"/api/class/eqptFt.json":     fans,
+		"/api/class/fabricNode.json": fabricNodes,
+	}
+
+	tests := []struct {
+		name               string
+		includeControllers bool
+		expectedPsu        map[string]float64
+		expectedFan        map[string]float64
+	}{
+		{
+			name:        "without controllers",
+			expectedPsu: map[string]float64{"nodeid=101,podid=1": 1, "nodeid=201,podid=2": 0},
+			expectedFan: map[string]float64{"nodeid=101,podid=1": 1, "nodeid=201,podid=2": 0},
+		},
+		{
+			name:               "with controllers",
+			includeControllers: true,
+			expectedPsu:        map[string]float64{"nodeid=1,podid=1": 0, "nodeid=101,podid=1": 1, "nodeid=201,podid=2": 0},
+			expectedFan:        map[string]float64{"nodeid=1,podid=1": 1, "nodeid=101,podid=1": 1, "nodeid=201,podid=2": 0},
+		},
+	}
+
+	defer viper.Set("include_controllers", viper.GetBool("include_controllers"))
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			viper.Set("include_controllers", test.includeControllers)
+			metrics := runQuery(newFixtureAPI(responses), aciAPI.equipmentRedundancy)
+			if metrics == nil {
+				t.Fatal("equipment_redundancy failed")
+			}
+			assertSeries(t, metrics, "node_psu_redundancy_ok", test.expectedPsu)
+			assertSeries(t, metrics, "node_fan_redundancy_ok", test.expectedFan)
+		})
+	}
+}
+
+func TestNodeRegistration(t *testing.T) {
+	client := func(serial string, nodeid string, name string, role string) string {
+		return `{"dhcpClient":{"attributes":{"id":"` + serial + `","nodeId":"` + nodeid + `","name":"` + name +
+			`","nodeRole":"` + role + `"}}}`
+	}
+	clients := `{"imdata":[` + strings.Join([]string{
+		client("FCH0001", "1", "apic1", "controller"),
+		client("FDO0101", "101", "leaf101", "leaf"),
+		client("FDO0103", "0", "", "leaf"),
+	}, ",") + `]}`
+	responses := map[string]string{"/api/class/dhcpClient.json": clients, "/api/class/fabricNode.json": fabricNodes}
+
+	tests := []struct {
+		name               string
+		includeControllers bool
+		expected           []string
+	}{
+		{
+			name:     "without controllers",
+			expected: []string{"FDO0101=active", "FDO0103=undiscovered"},
+		},
+		{
+			name:               "with controllers",
+			includeControllers: true,
+			expected:           []string{"FCH0001=unknown", "FDO0101=active", "FDO0103=undiscovered"},
+		},
+	}
+
+	defer viper.Set("include_controllers", viper.GetBool("include_controllers"))
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			viper.Set("include_controllers", test.includeControllers)
+			metrics := runQuery(newFixtureAPI(responses), aciAPI.nodeRegistration)
+			if metrics == nil {
+				t.Fatal("node_registration failed")
+			}
+			var actual []string
+			for _, metric := range metrics[0].Metrics {
+				if metric.Value == 1 {
+					actual = append(actual, metric.Labels["serial"]+"="+metric.Labels["state"])
+				}
+			}
+			sort.Strings(actual)
+			if strings.Join(actual, ",") != strings.Join(test.expected, ",") {
+				t.Errorf("got states %v, expected %v", actual, test.expected)
+			}
+		})
+	}
+}
+
+func TestScrapeMetrics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"imdata":[]}`))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name          string
+		scrapeMetrics bool
+		expected      []string
+	}{
+		{name: "enabled", scrapeMetrics: true, expected: []string{"query_success", "scrape_duration", "scrape_timed_out", "up"}},
+		{name: "disabled", scrapeMetrics: false, expected: []string{"up"}},
+	}
+
+	defer viper.Set("scrape_metrics", viper.GetBool("scrape_metrics"))
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			viper.Set("scrape_metrics", test.scrapeMetrics)
+			api := newFixtureAPI(map[string]string{
+				"/api/mo/topology/pod-1/node-1/av.json": `{"imdata":[{"infraCont":{"attributes":{"fbDmNm":"test"}}}]}`,
+			})
+			api.connection = *newAciConnction(api.ctx, Fabric{Apic: []string{server.URL}})
+			// A query of the scrape, so the query statistics have a series
+			api.stats.setSuccess("nodes", true)
+
+			_, metrics, err := api.CollectMetrics()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var actual []string
+			for _, metricDefinition := range metrics {
+				if len(metricDefinition.Metrics) > 0 {
+					actual = append(actual, metricDefinition.Name)
+				}
+			}
+			sort.Strings(actual)
+			if strings.Join(actual, ",") != strings.Join(test.expected, ",") {
+				t.Errorf("got metrics %v, expected %v", actual, test.expected)
+			}
+		})
+	}
+}
+
+func TestEndpointScale(t *testing.T) {
+	responses := map[string]string{
+		"/api/class/fvCEp.json?rsp-subtree-include=count": `{"imdata":[{"moCount":{"attributes":{"count":"45000"}}}]}`,
+	}
+
+	defer viper.Set("builtin_queries.endpoint_scale.max_endpoints", nil)
+	viper.Set("builtin_queries.endpoint_scale.max_endpoints", map[string]interface{}{"ex": 90000})
+
+	t.Run("configured generation", func(t *testing.T) {
+		api := newFixtureAPI(responses)
+		api.connection.fabricConfig.HardwareGeneration = "ex"
+		metrics := runQuery(api, aciAPI.endpointScale)
+		if metrics == nil {
+			t.Fatal("endpoint_scale failed")
+		}
+		assertSeries(t, metrics, "fabric_endpoint_scale", map[string]float64{"": 0.5})
+	})
+
+	t.Run("generation without max", func(t *testing.T) {
+		api := newFixtureAPI(responses)
+		api.connection.fabricConfig.HardwareGeneration = "fx"
+		if metrics := runQuery(api, aciAPI.endpointScale); metrics != nil {
+			t.Errorf("got %v, expected nil for a generation without max endpoints", metrics)
+		}
+	})
+
+	t.Run("fabric without generation", func(t *testing.T) {
+		ctx := context.WithValue(context.Background(), "fabric", "test")
+		ctx = context.WithValue(ctx, "querystats", newQueryStats())
+		if _, ok := newAciAPI(ctx, Fabric{Type: FabricTypeOnPrem}, AllQueries{}, "").confgBuiltInQueries["endpoint_scale"]; ok {
+			t.Error("endpoint_scale is executed for a fabric without hardware_generation")
+		}
+		if _, ok := newAciAPI(ctx, Fabric{Type: FabricTypeOnPrem, HardwareGeneration: "ex"}, AllQueries{}, "").confgBuiltInQueries["endpoint_scale"]; !ok {
+			t.Error("endpoint_scale is not executed for a fabric with hardware_generation")
+		}
+	})
+}
+
+func TestValidateFaultSeverities(t *testing.T) {
+	tests := []struct {
+		severities []string
+		err        bool
+	}{
+		{severities: []string{"crit", "maj", "minor", "warn"}},
+		{severities: []string{"crit"}},
+		{severities: []string{}},
+		{severities: []string{"crit", "critical"}, err: true},
+		{severities: []string{"warning"}, err: true},
+	}
+
+	defer viper.Set("builtin_queries.faults.severities", viper.GetStringSlice("builtin_queries.faults.severities"))
+	for _, test := range tests {
+		viper.Set("builtin_queries.faults.severities", test.severities)
+		err := validateFaultSeverities()
+		if test.err && err == nil {
+			t.Errorf("%v: got no error, expected an error", test.severities)
+		}
+		if !test.err && err != nil {
+			t.Errorf("%v: got error %s, expected none", test.severities, err)
+		}
+	}
+}
+
+func TestTruncateLabels(t *testing.T) {
+	series := func(descriptions ...string) []MetricDefinition {
+		metricDefinition := MetricDefinition{Name: "interface_info"}
+		for i, description := range descriptions {
+			metricDefinition.Metrics = append(metricDefinition.Metrics, Metric{
+				Labels: map[string]string{"interface": "eth1/1", "description": description},
+				Value:  float64(i),
+			})
+		}
+		return []MetricDefinition{metricDefinition}
+	}
+
+	tests := []struct {
+		name         string
+		maxLength    int
+		descriptions []string
+		expected     map[string]float64
+	}{
+		{
+			name:         "no limit",
+			descriptions: []string{"uplink to the core switch in rack 1"},
+			expected:     map[string]float64{"description=uplink to the core switch in rack 1,interface=eth1/1": 0},
+		},
+		{
+			name:         "shorter than the max",
+			maxLength:    40,
+			descriptions: []string{"uplink to the core switch in rack 1"},
+			expected:     map[string]float64{"description=uplink to the core switch in rack 1,interface=eth1/1": 0},
+		},
+		{
+			name:         "same beginning stay unique",
+			maxLength:    20,
+			descriptions: []string{"uplink to the core switch in rack 1", "uplink to the core switch in rack 2"},
+			expected: map[string]float64{
+				"description=uplink to...c2358afe,interface=eth1/1": 0,
+				"description=uplink to...c135896b,interface=eth1/1": 1,
+			},
+		},
+		{
+			name:         "too short for the hash",
+			maxLength:    6,
+			descriptions: []string{"uplink to the core switch in rack 1", "uplink to the core switch in rack 2", "server"},
+			expected: map[string]float64{
+				"description=uplink,interface=eth1/1": 0,
+				"description=server,interface=eth1/1": 2,
+			},
+		},
+	}
+
+	api := newFixtureAPI(nil)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			metrics := api.truncateLabels(series(test.descriptions...), test.maxLength)
+			assertSeries(t, metrics, "interface_info", test.expected)
+			for _, metric := range metrics[0].Metrics {
+				if length := len([]rune(metric.Labels["description"])); test.maxLength > 0 && length > test.maxLength {
+					t.Errorf("%s: got length %d, expected at most %d", metric.Labels["description"], length, test.maxLength)
+				}
+			}
+		})
+	}
+}
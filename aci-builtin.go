@@ -0,0 +1,2227 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+// Copyright 2020 Opsdis AB
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tidwall/gjson"
+)
+
+// encap return the usage of the vlan pools and the number of allocated vxlan vnids
+func (p aciAPI) encap(ch chan []MetricDefinition) {
+	pools, err := p.queryer.getByClassQuery("fvnsVlanInstP", "?rsp-subtree=children&rsp-subtree-class=fvnsEncapBlk")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error("encap not supported", err)
+		ch <- nil
+		return
+	}
+
+	// All vlans deployed on the leafs, independent of node
+	deployed, err := p.queryer.getByClassQuery("vlanCktEp", "")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error("encap not supported", err)
+		ch <- nil
+		return
+	}
+
+	usedVlans := make(map[int]bool)
+	gjson.Get(deployed, builtinPath("encap", "deployed_vlans", "imdata.#.vlanCktEp.attributes.encap")).ForEach(func(key, value gjson.Result) bool {
+		if vlan, ok := parseVlan(value.Str); ok {
+			usedVlans[vlan] = true
+		}
+		return true
+	})
+
+	metricDefinitionUsed := MetricDefinition{}
+	metricDefinitionUsed.Name = "encap_vlan_used"
+	metricDefinitionUsed.Description = MetricDesc{
+		Help: "Returns the number of vlans in the vlan pool that are deployed in the fabric",
+		Type: "gauge",
+		Unit: "",
+	}
+
+	metricDefinitionAvailable := MetricDefinition{}
+	metricDefinitionAvailable.Name = "encap_vlan_available"
+	metricDefinitionAvailable.Description = MetricDesc{
+		Help: "Returns the number of vlans in the vlan pool that are not deployed in the fabric",
+		Type: "gauge",
+		Unit: "",
+	}
+
+	gjson.Get(pools, "imdata").ForEach(func(key, value gjson.Result) bool {
+		size := 0
+		used := 0
+		value.Get(builtinPath("encap", "vlan_blocks", "fvnsVlanInstP.children.#.fvnsEncapBlk.attributes")).ForEach(func(key, block gjson.Result) bool {
+			from, okFrom := parseVlan(block.Get("from").Str)
+			to, okTo := parseVlan(block.Get("to").Str)
+			if !okFrom || !okTo {
+				return true
+			}
+			size = size + to - from + 1
+			for vlan := from; vlan <= to; vlan++ {
+				if usedVlans[vlan] {
+					used++
+				}
+			}
+			return true
+		})
+
+		metric := Metric{}
+		metric.Labels = make(map[string]string)
+		metric.Labels["pool"] = value.Get("fvnsVlanInstP.attributes.name").Str
+		metric.Labels["allocmode"] = value.Get("fvnsVlanInstP.attributes.allocMode").Str
+		metric.Value = float64(used)
+		metricDefinitionUsed.Metrics = append(metricDefinitionUsed.Metrics, metric)
+
+		metric = Metric{}
+		metric.Labels = make(map[string]string)
+		metric.Labels["pool"] = value.Get("fvnsVlanInstP.attributes.name").Str
+		metric.Labels["allocmode"] = value.Get("fvnsVlanInstP.attributes.allocMode").Str
+		metric.Value = float64(size - used)
+		metricDefinitionAvailable.Metrics = append(metricDefinitionAvailable.Metrics, metric)
+
+		return true // keep iterating
+	})
+
+	// Every bridge domain and vrf is allocated a vxlan vnid, the seg attribute
+	metricDefinitionVnid := MetricDefinition{}
+	metricDefinitionVnid.Name = "encap_vnid_allocated"
+	metricDefinitionVnid.Description = MetricDesc{
+		Help: "Returns the number of allocated vxlan vnids by type",
+		Type: "gauge",
+		Unit: "",
+	}
+
+	for class, vnidType := range map[string]string{"fvBD": "bd", "fvCtx": "vrf"} {
+		data, err := p.queryer.getByClassQuery(class, "?rsp-subtree-include=count")
+		if err != nil {
+			continue
+		}
+		metric := Metric{}
+		metric.Labels = make(map[string]string)
+		metric.Labels["type"] = vnidType
+		metric.Value = p.toFloat(gjson.Get(data, builtinPath("encap", "vnid_count", "imdata.0.moCount.attributes.count")).Str)
+		metricDefinitionVnid.Metrics = append(metricDefinitionVnid.Metrics, metric)
+	}
+
+	ch <- []MetricDefinition{metricDefinitionUsed, metricDefinitionAvailable, metricDefinitionVnid}
+}
+
+// parseVlan return the vlan id of an encap in the format vlan-100
+func parseVlan(encap string) (int, bool) {
+	if !strings.HasPrefix(encap, "vlan-") {
+		return 0, false
+	}
+	vlan, err := strconv.Atoi(strings.TrimPrefix(encap, "vlan-"))
+	if err != nil {
+		return 0, false
+	}
+	return vlan, true
+}
+
+// apicClusterQuery is the query of the controllers of the cluster, the same as the query infra_node_info of the
+// example configuration so the response is shared with it by the scrape cache and no extra request is done
+const apicClusterQuery = "?query-target-filter=ne(infraWiNode.apicMode,\"standby\")"
+
+// apicCluster return if all the apic controllers in the cluster is fully fit, as seen by all controllers
+func (p aciAPI) apicCluster(ch chan []MetricDefinition) {
+	data, err := p.queryer.getByClassQuery("infraWiNode", apicClusterQuery)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error(fmt.Sprintf("apic_cluster not supported - %s", err))
+		ch <- nil
+		return
+	}
+
+	nodes := gjson.Get(data, builtinPath("apic_cluster", "nodes", "imdata.#.infraWiNode.attributes"))
+	if len(nodes.Array()) == 0 {
+		ch <- []MetricDefinition{}
+		return
+	}
+
+	fullyFit := 1.0
+	nodes.ForEach(func(key, value gjson.Result) bool {
+		if value.Get("apicMode").Str == "standby" {
+			// A cold standby controller is not part of the cluster until it is promoted
+			return true
+		}
+		if value.Get("health").Str != "fully-fit" || value.Get("operSt").Str != "available" {
+			fullyFit = 0.0
+			return false
+		}
+		return true // keep iterating
+	})
+
+	metricDefinition := MetricDefinition{}
+	metricDefinition.Name = "apic_cluster_fully_fit"
+	metricDefinition.Description = MetricDesc{
+		Help: "Returns 1 if all apic controllers in the cluster are fully fit and available, else 0",
+		Type: "gauge",
+		Unit: "",
+	}
+
+	metric := Metric{}
+	metric.Labels = make(map[string]string)
+	metric.Value = fullyFit
+	metricDefinition.Metrics = []Metric{metric}
+
+	ch <- []MetricDefinition{metricDefinition}
+}
+
+// faultSeverities map the severity of a fault instance to the severity label used by the fault metrics
+var faultSeverities = map[string]string{
+	"critical": "crit",
+	"major":    "maj",
+	"minor":    "minor",
+	"warning":  "warn",
+}
+
+// validateFaultSeverities return an error if a severity of builtin_queries.faults.severities is not a severity label of
+// the fault metrics, like critical instead of crit, that would select no faults
+func validateFaultSeverities() error {
+	labels := make([]string, 0, len(faultSeverities))
+	for _, label := range faultSeverities {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for _, severity := range viper.GetStringSlice("builtin_queries.faults.severities") {
+		if !contains(labels, severity) {
+			return fmt.Errorf("severity %s is not valid, must be one of %s", severity, strings.Join(labels, ", "))
+		}
+	}
+	return nil
+}
+
+// faultsByDomain return the number of faults by the domain, like infra, tenant and access, and severity
+func (p aciAPI) faultsByDomain(ch chan []MetricDefinition) {
+	data, err := p.queryer.getByQuery("fault_instances")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error("faults_by_domain not supported", err)
+		ch <- nil
+		return
+	}
+
+	type domainSeverity struct {
+		domain   string
+		severity string
+	}
+	counts := make(map[domainSeverity]int)
+
+	gjson.Get(data, builtinPath("faults_by_domain", "faults", "imdata.#.faultInst.attributes")).ForEach(func(key, value gjson.Result) bool {
+		severity, ok := faultSeverities[value.Get("severity").Str]
+		if !ok {
+			// cleared and info faults are not counted
+			return true
+		}
+		counts[domainSeverity{domain: value.Get("domain").Str, severity: severity}]++
+		return true // keep iterating
+	})
+
+	metricDefinition := MetricDefinition{}
+	metricDefinition.Name = "faults_by_domain"
+	metricDefinition.Description = MetricDesc{
+		Help: "Returns the total number of faults by domain and severity",
+		Type: "gauge",
+		Unit: "",
+	}
+
+	for k, count := range counts {
+		metric := Metric{}
+		metric.Labels = make(map[string]string)
+		metric.Labels["domain"] = k.domain
+		metric.Labels["severity"] = k.severity
+		metric.Value = float64(count)
+		metricDefinition.Metrics = append(metricDefinition.Metrics, metric)
+	}
+
+	ch <- []MetricDefinition{metricDefinition}
+}
+
+// tenantFaults return the number of faults of the objects in each tenant by severity. The tenant is taken from the
+// dn of the fault, so faults of the fabric and access policies are not counted
+func (p aciAPI) tenantFaults(ch chan []MetricDefinition) {
+	data, err := p.queryer.getByQuery("fault_instances")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error("tenant_faults not supported", err)
+		ch <- nil
+		return
+	}
+
+	type tenantSeverity struct {
+		tenant   string
+		severity string
+	}
+	counts := make(map[tenantSeverity]int)
+
+	gjson.Get(data, builtinPath("tenant_faults", "faults", "imdata.#.faultInst.attributes")).ForEach(func(key, value gjson.Result) bool {
+		severity, ok := faultSeverities[value.Get("severity").Str]
+		if !ok {
+			// cleared and info faults are not counted
+			return true
+		}
+		labels := parseLabels(value.Get("dn").Str, "^uni/tn-(?P<tenant>[^/]+)/")
+		if len(labels) == 0 {
+			return true
+		}
+		counts[tenantSeverity{tenant: labels["tenant"], severity: severity}]++
+		return true // keep iterating
+	})
+
+	metricDefinition := MetricDefinition{}
+	metricDefinition.Name = "tenant_faults"
+	metricDefinition.Description = MetricDesc{
+		Help: "Returns the total number of faults by tenant and severity",
+		Type: "gauge",
+		Unit: "",
+	}
+
+	for k, count := range counts {
+		metric := Metric{}
+		metric.Labels = make(map[string]string)
+		metric.Labels["tenant"] = k.tenant
+		metric.Labels["severity"] = k.severity
+		metric.Value = float64(count)
+		metricDefinition.Metrics = append(metricDefinition.Metrics, metric)
+	}
+
+	ch <- []MetricDefinition{metricDefinition}
+}
+
+// faultsByLifecycle return the number of faults by the lifecycle, like soaking, raised and retaining, and severity.
+// Faults in the retaining lifecycle are cleared, so they are counted by the severity they were raised with
+func (p aciAPI) faultsByLifecycle(ch chan []MetricDefinition) {
+	data, err := p.queryer.getByQuery("fault_instances")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error("faults_by_lifecycle not supported", err)
+		ch <- nil
+		return
+	}
+
+	type lifecycleSeverity struct {
+		lifecycle string
+		severity  string
+	}
+	counts := make(map[lifecycleSeverity]int)
+
+	gjson.Get(data, builtinPath("faults_by_lifecycle", "faults", "imdata.#.faultInst.attributes")).ForEach(func(key, value gjson.Result) bool {
+		severity := value.Get("severity").Str
+		if severity == "cleared" {
+			severity = value.Get("origSeverity").Str
+		}
+		label, ok := faultSeverities[severity]
+		if !ok {
+			// info faults are not counted
+			return true
+		}
+		counts[lifecycleSeverity{lifecycle: value.Get("lc").Str, severity: label}]++
+		return true // keep iterating
+	})
+
+	metricDefinition := MetricDefinition{}
+	metricDefinition.Name = "faults_by_lifecycle"
+	metricDefinition.Description = MetricDesc{
+		Help: "Returns the total number of faults by lifecycle and severity",
+		Type: "gauge",
+		Unit: "",
+	}
+
+	for k, count := range counts {
+		metric := Metric{}
+		metric.Labels = make(map[string]string)
+		metric.Labels["lifecycle"] = k.lifecycle
+		metric.Labels["severity"] = k.severity
+		metric.Value = float64(count)
+		metricDefinition.Metrics = append(metricDefinition.Metrics, metric)
+	}
+
+	ch <- []MetricDefinition{metricDefinition}
+}
+
+// configExport return the status and time of the last job of each configuration export policy, and the time since the
+// last successful job of any export policy, the age of the latest backup
+func (p aciAPI) configExport(ch chan []MetricDefinition) {
+	data, err := p.queryer.getByClassQuery("configJob", "")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error("config_export not supported", err)
+		ch <- nil
+		return
+	}
+
+	lastJobs := make(map[string]gjson.Result)
+	lastSuccess := 0.0
+	gjson.Get(data, builtinPath("config_export", "jobs", "imdata.#.configJob.attributes")).ForEach(func(key, value gjson.Result) bool {
+		// The jobs are children of the job container of the export policy
+		labels := parseLabels(value.Get("dn").Str, "^uni/backupst/jobs-\\[uni/fabric/configexp-(?P<policy>[^\\]]+)\\]/")
+		policy, ok := labels["policy"]
+		if !ok {
+			return true
+		}
+		if value.Get("operSt").Str == "success" && p.toFloat(value.Get("executeTime").Str) > lastSuccess {
+			lastSuccess = p.toFloat(value.Get("executeTime").Str)
+		}
+		last, ok := lastJobs[policy]
+		if !ok || p.toFloat(value.Get("executeTime").Str) > p.toFloat(last.Get("executeTime").Str) {
+			lastJobs[policy] = value
+		}
+		return true // keep iterating
+	})
+
+	metricDefinitionStatus := MetricDefinition{}
+	metricDefinitionStatus.Name = "config_export_last_status"
+	metricDefinitionStatus.Description = MetricDesc{
+		Help: "Returns the status of the last configuration export job of the export policy (1=success, 0=fail)",
+		Type: "gauge",
+		Unit: "",
+	}
+
+	metricDefinitionTimestamp := MetricDefinition{}
+	metricDefinitionTimestamp.Name = "config_export_last_timestamp"
+	metricDefinitionTimestamp.Description = MetricDesc{
+		Help: "Returns the time of the last configuration export job of the export policy",
+		Type: "gauge",
+		Unit: "seconds",
+	}
+
+	for policy, job := range lastJobs {
+		metric := Metric{}
+		metric.Labels = make(map[string]string)
+		metric.Labels["policy"] = policy
+		if job.Get("operSt").Str == "success" {
+			metric.Value = 1
+		}
+		metricDefinitionStatus.Metrics = append(metricDefinitionStatus.Metrics, metric)
+
+		metric = Metric{}
+		metric.Labels = make(map[string]string)
+		metric.Labels["policy"] = policy
+		metric.Value = p.toFloat(job.Get("executeTime").Str)
+		metricDefinitionTimestamp.Metrics = append(metricDefinitionTimestamp.Metrics, metric)
+	}
+
+	metricDefinitionAge := MetricDefinition{}
+	metricDefinitionAge.Name = "seconds_since_last_backup"
+	metricDefinitionAge.Description = MetricDesc{
+		Help: "Returns the number of seconds since the last successful configuration export job of any export policy",
+		Type: "gauge",
+		Unit: "",
+	}
+	// No metric if there is no successful export, so it can be alerted on with absent
+	if lastSuccess > 0 {
+		metric := Metric{}
+		metric.Labels = make(map[string]string)
+		metric.Value = roundPrecision(float64(time.Now().Unix()) - lastSuccess)
+		metricDefinitionAge.Metrics = append(metricDefinitionAge.Metrics, metric)
+	}
+
+	ch <- []MetricDefinition{metricDefinitionStatus, metricDefinitionTimestamp, metricDefinitionAge}
+}
+
+// dhcpRelay return the state of the dhcp relay labels of the bridge domains. A relay label is ok if the dhcp relay
+// policy it refer to exists and has at least one formed provider
+func (p aciAPI) dhcpRelay(ch chan []MetricDefinition) {
+	relays, err := p.queryer.getByClassQuery("dhcpRelayP", "?rsp-subtree=children&rsp-subtree-class=dhcpRsProv")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error("dhcp_relay not supported", err)
+		ch <- nil
+		return
+	}
+
+	labels, err := p.queryer.getByClassQuery("dhcpLbl", "")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error("dhcp_relay not supported", err)
+		ch <- nil
+		return
+	}
+
+	// The relay policies with a formed provider, by dn
+	formedRelays := make(map[string]bool)
+	gjson.Get(relays, "imdata").ForEach(func(key, value gjson.Result) bool {
+		value.Get(builtinPath("dhcp_relay", "provider_states", "dhcpRelayP.children.#.dhcpRsProv.attributes.state")).ForEach(func(key, state gjson.Result) bool {
+			if state.Str == "formed" {
+				formedRelays[value.Get("dhcpRelayP.attributes.dn").Str] = true
+				return false
+			}
+			return true
+		})
+		return true // keep iterating
+	})
+
+	metricDefinition := MetricDefinition{}
+	metricDefinition.Name = "dhcp_relay_state"
+	metricDefinition.Description = MetricDesc{
+		Help: "Returns the state of the dhcp relay of the bridge domain (1=ok, 0=relay policy missing or without provider)",
+		Type: "gauge",
+		Unit: "",
+	}
+
+	gjson.Get(labels, builtinPath("dhcp_relay", "labels", "imdata.#.dhcpLbl.attributes")).ForEach(func(key, value gjson.Result) bool {
+		metric := Metric{}
+		metric.Labels = parseLabels(value.Get("dn").Str, "^uni/tn-(?P<tenant>[^/]+)/BD-(?P<bd>[^/]+)/dhcplbl-")
+		tenant, ok := metric.Labels["tenant"]
+		if !ok {
+			return true
+		}
+
+		// The relay policy is defined in the tenant of the bridge domain or in infra
+		relayDn := fmt.Sprintf("uni/tn-%s/relayp-%s", tenant, value.Get("name").Str)
+		if value.Get("owner").Str == "infra" {
+			relayDn = fmt.Sprintf("uni/infra/relayp-%s", value.Get("name").Str)
+		}
+
+		metric.Labels["relay"] = value.Get("name").Str
+		if formedRelays[relayDn] {
+			metric.Value = 1
+		}
+		metricDefinition.Metrics = append(metricDefinition.Metrics, metric)
+		return true // keep iterating
+	})
+
+	ch <- []MetricDefinition{metricDefinition}
+}
+
+// podNode identify a node of the fabric
+type podNode struct {
+	podid  string
+	nodeid string
+}
+
+// excludedControllers return the apic controllers, from the fabric nodes with the role controller, that are left out of
+// the built-in queries that report by node. If include_controllers is set no controllers are excluded and the nodes
+// are not queried. The fabricNode response is shared with node_registration by the scrape cache
+func (p aciAPI) excludedControllers() (map[podNode]bool, error) {
+	controllers := make(map[podNode]bool)
+	if viper.GetBool("include_controllers") {
+		return controllers, nil
+	}
+	nodes, err := p.queryer.getByClassQuery("fabricNode", "")
+	if err != nil {
+		return nil, err
+	}
+	gjson.Get(nodes, "imdata.#.fabricNode.attributes").ForEach(func(key, value gjson.Result) bool {
+		if value.Get("role").Str != "controller" {
+			return true
+		}
+		labels := parseLabels(value.Get("dn").Str, "^topology/pod-(?P<podid>[1-9][0-9]*)/node-(?P<nodeid>[1-9][0-9]*)")
+		if len(labels) > 0 {
+			controllers[podNode{podid: labels["podid"], nodeid: labels["nodeid"]}] = true
+		}
+		return true
+	})
+	return controllers, nil
+}
+
+// withoutControllers return the series that are not of the excluded controllers, by the podid and nodeid labels
+func withoutControllers(metrics []Metric, controllers map[podNode]bool) []Metric {
+	if len(controllers) == 0 {
+		return metrics
+	}
+	var nodeMetrics []Metric
+	for _, metric := range metrics {
+		if !controllers[podNode{podid: metric.Labels["podid"], nodeid: metric.Labels["nodeid"]}] {
+			nodeMetrics = append(nodeMetrics, metric)
+		}
+	}
+	return nodeMetrics
+}
+
+// accessPorts return the number of access ports configured in the interface profiles, the number of ports with an
+// attachable entity profile deployed on the leafs and the number of faults of the access policies
+func (p aciAPI) accessPorts(ch chan []MetricDefinition) {
+	blocks, err := p.queryer.getByClassQuery("infraPortBlk", "")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error("access_ports not supported", err)
+		ch <- nil
+		return
+	}
+
+	deployed, err := p.queryer.getByClassQuery("l1RsAttEntityPCons", "")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error("access_ports not supported", err)
+		ch <- nil
+		return
+	}
+
+	configuredPorts := make(map[string]int)
+	gjson.Get(blocks, builtinPath("access_ports", "port_blocks", "imdata.#.infraPortBlk.attributes")).ForEach(func(key, value gjson.Result) bool {
+		labels := parseLabels(value.Get("dn").Str, "^uni/infra/accportprof-(?P<profile>[^/]+)/")
+		profile, ok := labels["profile"]
+		if !ok {
+			return true
+		}
+		cards := p.toFloat(value.Get("toCard").Str) - p.toFloat(value.Get("fromCard").Str) + 1
+		ports := p.toFloat(value.Get("toPort").Str) - p.toFloat(value.Get("fromPort").Str) + 1
+		configuredPorts[profile] += int(cards * ports)
+		return true // keep iterating
+	})
+
+	deployedPorts := make(map[podNode]int)
+	gjson.Get(deployed, builtinPath("access_ports", "deployed_ports", "imdata.#.l1RsAttEntityPCons.attributes")).ForEach(func(key, value gjson.Result) bool {
+		labels := parseLabels(value.Get("dn").Str, "^topology/pod-(?P<podid>[1-9][0-9]*)/node-(?P<nodeid>[1-9][0-9]*)/")
+		if len(labels) == 0 {
+			return true
+		}
+		deployedPorts[podNode{podid: labels["podid"], nodeid: labels["nodeid"]}]++
+		return true // keep iterating
+	})
+
+	metricDefinitionConfigured := MetricDefinition{}
+	metricDefinitionConfigured.Name = "access_ports_configured"
+	metricDefinitionConfigured.Description = MetricDesc{
+		Help: "Returns the number of ports configured by the port blocks of the interface profile",
+		Type: "gauge",
+		Unit: "",
+	}
+	for profile, count := range configuredPorts {
+		metric := Metric{}
+		metric.Labels = make(map[string]string)
+		metric.Labels["profile"] = profile
+		metric.Value = float64(count)
+		metricDefinitionConfigured.Metrics = append(metricDefinitionConfigured.Metrics, metric)
+	}
+
+	metricDefinitionDeployed := MetricDefinition{}
+	metricDefinitionDeployed.Name = "access_ports_deployed"
+	metricDefinitionDeployed.Description = MetricDesc{
+		Help: "Returns the number of ports of the node with an attachable entity profile deployed",
+		Type: "gauge",
+		Unit: "",
+	}
+	for node, count := range deployedPorts {
+		metric := Metric{}
+		metric.Labels = make(map[string]string)
+		metric.Labels["podid"] = node.podid
+		metric.Labels["nodeid"] = node.nodeid
+		metric.Value = float64(count)
+		metricDefinitionDeployed.Metrics = append(metricDefinitionDeployed.Metrics, metric)
+	}
+
+	metricDefinitions := []MetricDefinition{metricDefinitionConfigured, metricDefinitionDeployed}
+
+	faults, err := p.queryer.getByClassQuery("faultInst",
+		"?query-target-filter=wcard(faultInst.dn,\"^uni/infra/\")&rsp-subtree-include=count")
+	if err == nil {
+		metricDefinitionFaults := MetricDefinition{}
+		metricDefinitionFaults.Name = "fabric_access_policy_faults"
+		metricDefinitionFaults.Description = MetricDesc{
+			Help: "Returns the number of faults of the fabric access policies",
+			Type: "gauge",
+			Unit: "",
+		}
+		metric := Metric{}
+		metric.Labels = make(map[string]string)
+		metric.Value = p.toFloat(gjson.Get(faults, builtinPath("access_ports", "fault_count", "imdata.0.moCount.attributes.count")).Str)
+		metricDefinitionFaults.Metrics = []Metric{metric}
+		metricDefinitions = append(metricDefinitions, metricDefinitionFaults)
+	}
+
+	ch <- metricDefinitions
+}
+
+// equipmentRedundancy return if the power supplies and the fan trays of the nodes are redundant, where the number of
+// operational units must be at least the required number of units. The apics are only reported if include_controllers
+// is set
+func (p aciAPI) equipmentRedundancy(ch chan []MetricDefinition) {
+	psus, err := p.queryer.getByClassQuery("eqptPsu", "")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error("equipment_redundancy not supported", err)
+		ch <- nil
+		return
+	}
+
+	fans, err := p.queryer.getByClassQuery("eqptFt", "")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error("equipment_redundancy not supported", err)
+		ch <- nil
+		return
+	}
+
+	controllers, err := p.excludedControllers()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error(fmt.Sprintf("equipment_redundancy not supported - %s", err))
+		ch <- nil
+		return
+	}
+
+	metricDefinitionPsu := unitRedundancy(psus, builtinPath("equipment_redundancy", "psus", "imdata.#.eqptPsu.attributes"), viper.GetInt("builtin_queries.equipment_redundancy.psu_required"))
+	metricDefinitionPsu.Name = "node_psu_redundancy_ok"
+	metricDefinitionPsu.Description = MetricDesc{
+		Help: "Returns 1 if the number of operational power supplies of the node is at least the required number, else 0",
+		Type: "gauge",
+		Unit: "",
+	}
+
+	metricDefinitionFan := unitRedundancy(fans, builtinPath("equipment_redundancy", "fans", "imdata.#.eqptFt.attributes"), viper.GetInt("builtin_queries.equipment_redundancy.fan_required"))
+	metricDefinitionFan.Name = "node_fan_redundancy_ok"
+	metricDefinitionFan.Description = MetricDesc{
+		Help: "Returns 1 if the number of operational fan trays of the node is at least the required number, else 0",
+		Type: "gauge",
+		Unit: "",
+	}
+
+	metricDefinitionPsu.Metrics = withoutControllers(metricDefinitionPsu.Metrics, controllers)
+	metricDefinitionFan.Metrics = withoutControllers(metricDefinitionFan.Metrics, controllers)
+
+	ch <- []MetricDefinition{metricDefinitionPsu, metricDefinitionFan}
+}
+
+// unitRedundancy return a metric per node that is 1 if the node have at least the required number of operational
+// units, where path select the attributes of the units. If required is 0 all units present in the node must be operational. Nodes without any units
+// present are not included
+func unitRedundancy(data string, path string, required int) MetricDefinition {
+	present := make(map[podNode]int)
+	operational := make(map[podNode]int)
+	gjson.Get(data, path).ForEach(func(key, value gjson.Result) bool {
+		labels := parseLabels(value.Get("dn").Str, "^topology/pod-(?P<podid>[1-9][0-9]*)/node-(?P<nodeid>[1-9][0-9]*)/")
+		if len(labels) == 0 {
+			return true
+		}
+		node := podNode{podid: labels["podid"], nodeid: labels["nodeid"]}
+		switch value.Get("operSt").Str {
+		case "absent":
+			// An empty slot
+		case "ok":
+			present[node]++
+			operational[node]++
+		default:
+			present[node]++
+		}
+		return true // keep iterating
+	})
+
+	metricDefinition := MetricDefinition{}
+	for node := range present {
+		count := operational[node]
+		metric := Metric{}
+		metric.Labels = make(map[string]string)
+		metric.Labels["podid"] = node.podid
+		metric.Labels["nodeid"] = node.nodeid
+
+		nodeRequired := required
+		if nodeRequired == 0 {
+			nodeRequired = present[node]
+		}
+		if count >= nodeRequired {
+			metric.Value = 1
+		}
+		metricDefinition.Metrics = append(metricDefinition.Metrics, metric)
+	}
+	return metricDefinition
+}
+
+// activeSessions return the number of active login sessions to the apic by user and login domain. A session is active
+// if its last session record is not a logout and is within the session timeout
+func (p aciAPI) activeSessions(ch chan []MetricDefinition) {
+	timeout := viper.GetDuration("builtin_queries.active_sessions.session_timeout") * time.Second
+	since := time.Now().UTC().Add(-timeout).Format("2006-01-02T15:04:05")
+	data, err := p.queryer.getByClassQuery("aaaSessionLR",
+		fmt.Sprintf("?query-target-filter=gt(aaaSessionLR.created,\"%s\")&order-by=aaaSessionLR.created", since))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error("active_sessions not supported", err)
+		ch <- nil
+		return
+	}
+
+	type session struct {
+		user    string
+		domain  string
+		created float64
+		active  bool
+	}
+	// The session records are ordered by creation, so the last record of a session decide if it is active
+	sessions := make(map[string]*session)
+	gjson.Get(data, builtinPath("active_sessions", "sessions", "imdata.#.aaaSessionLR.attributes")).ForEach(func(key, value gjson.Result) bool {
+		labels := parseLabels(value.Get("dn").Str, "/sess-(?P<session>[0-9]+)$")
+		id, ok := labels["session"]
+		if !ok {
+			return true
+		}
+		s, ok := sessions[id]
+		if !ok {
+			s = &session{created: p.toFloat(value.Get("created").Str)}
+			sessions[id] = s
+		}
+		s.user, s.domain = sessionUser(value.Get("user").Str, value.Get("affected").Str)
+		s.active = value.Get("ind").Str != "logout"
+		return true // keep iterating
+	})
+
+	type userDomain struct {
+		user   string
+		domain string
+	}
+	count := make(map[userDomain]int)
+	oldest := make(map[userDomain]float64)
+	for _, s := range sessions {
+		if !s.active {
+			continue
+		}
+		key := userDomain{user: s.user, domain: s.domain}
+		count[key]++
+		if first, ok := oldest[key]; !ok || s.created < first {
+			oldest[key] = s.created
+		}
+	}
+
+	metricDefinitionSessions := MetricDefinition{}
+	metricDefinitionSessions.Name = "apic_active_sessions"
+	metricDefinitionSessions.Description = MetricDesc{
+		Help: "Returns the number of active login sessions to the apic by user and login domain",
+		Type: "gauge",
+		Unit: "",
+	}
+
+	metricDefinitionOldest := MetricDefinition{}
+	metricDefinitionOldest.Name = "apic_active_sessions_oldest_timestamp"
+	metricDefinitionOldest.Description = MetricDesc{
+		Help: "Returns the creation time of the oldest active login session to the apic by user and login domain",
+		Type: "gauge",
+		Unit: "seconds",
+	}
+
+	for key, value := range count {
+		metric := Metric{}
+		metric.Labels = make(map[string]string)
+		metric.Labels["user"] = key.user
+		metric.Labels["domain"] = key.domain
+		metric.Value = float64(value)
+		metricDefinitionSessions.Metrics = append(metricDefinitionSessions.Metrics, metric)
+
+		metric = Metric{}
+		metric.Labels = make(map[string]string)
+		metric.Labels["user"] = key.user
+		metric.Labels["domain"] = key.domain
+		metric.Value = oldest[key]
+		metricDefinitionOldest.Metrics = append(metricDefinitionOldest.Metrics, metric)
+	}
+
+	ch <- []MetricDefinition{metricDefinitionSessions, metricDefinitionOldest}
+}
+
+// sessionUser return the user name and login domain of a session record. Remote users log in with a name like
+// apic#DOMAIN\user, local users are in the domain local
+func sessionUser(user string, affected string) (string, string) {
+	if i := strings.LastIndex(user, "\\"); i >= 0 {
+		return user[i+1:], strings.TrimPrefix(user[:i], "apic#")
+	}
+	if strings.Contains(affected, "/remoteuser-") {
+		return user, "remote"
+	}
+	return user, "local"
+}
+
+// coop return the number of endpoint records in the COOP database of each spine. The spines should have the same
+// number of records, a divergence indicate an inconsistent endpoint database
+func (p aciAPI) coop(ch chan []MetricDefinition) {
+	spines, err := p.queryer.getByClassQuery("fabricNode", "?query-target-filter=eq(fabricNode.role,\"spine\")")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error("coop not supported", err)
+		ch <- nil
+		return
+	}
+
+	metricDefinition := MetricDefinition{}
+	metricDefinition.Name = "coop_endpoint_records"
+	metricDefinition.Description = MetricDesc{
+		Help: "Returns the number of endpoint records in the COOP database of the spine",
+		Type: "gauge",
+		Unit: "",
+	}
+
+	failed := false
+	gjson.Get(spines, builtinPath("coop", "spines", "imdata.#.fabricNode.attributes.dn")).ForEach(func(key, value gjson.Result) bool {
+		labels := parseLabels(value.Str, "^topology/pod-(?P<podid>[1-9][0-9]*)/node-(?P<nodeid>[1-9][0-9]*)$")
+		if len(labels) == 0 {
+			return true
+		}
+		data, err := p.queryer.getByNodeClassQuery(value.Str, "coopEpRec", "?rsp-subtree-include=count")
+		if err != nil {
+			failed = true
+			return true
+		}
+		metric := Metric{}
+		metric.Labels = labels
+		metric.Value = p.toFloat(gjson.Get(data, builtinPath("coop", "endpoint_count", "imdata.0.moCount.attributes.count")).Str)
+		metricDefinition.Metrics = append(metricDefinition.Metrics, metric)
+		return true // keep iterating
+	})
+
+	// The records of the spines can only be compared if all spines are included
+	if failed {
+		ch <- nil
+		return
+	}
+
+	ch <- []MetricDefinition{metricDefinition}
+}
+
+// sviStatus return the operational state of the L3Out SVIs, the paths of the L3Outs with interface type ext-svi, on
+// each leaf they are deployed to. The SVI of a leaf is named by the internal vlan the encap vlan is mapped to, so the
+// path encap is matched to the SVI through the deployed vlans of the leaf
+func (p aciAPI) sviStatus(ch chan []MetricDefinition) {
+	paths, err := p.queryer.getByClassQuery("l3extRsPathL3OutAtt", "?query-target-filter=eq(l3extRsPathL3OutAtt.ifInstT,\"ext-svi\")")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error("svi_status not supported", err)
+		ch <- nil
+		return
+	}
+
+	deployed, err := p.queryer.getByClassQuery("vlanCktEp", "")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error("svi_status not supported", err)
+		ch <- nil
+		return
+	}
+
+	svis, err := p.queryer.getByClassQuery("sviIf", "")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error("svi_status not supported", err)
+		ch <- nil
+		return
+	}
+
+	// The internal vlan of each encap vlan on a node, keyed by <nodeid>/<encap>
+	internalVlans := make(map[string]string)
+	gjson.Get(deployed, builtinPath("svi_status", "deployed_vlans", "imdata.#.vlanCktEp.attributes")).ForEach(func(key, value gjson.Result) bool {
+		labels := parseLabels(value.Get("dn").Str, "^topology/pod-[1-9][0-9]*/node-(?P<nodeid>[1-9][0-9]*)/")
+		if len(labels) == 0 {
+			return true
+		}
+		internalVlans[labels["nodeid"]+"/"+value.Get("encap").Str] = value.Get("id").Str
+		return true
+	})
+
+	// The operational state of each SVI on a node, keyed by <nodeid>/<svi id>
+	sviStates := make(map[string]string)
+	gjson.Get(svis, builtinPath("svi_status", "svis", "imdata.#.sviIf.attributes")).ForEach(func(key, value gjson.Result) bool {
+		labels := parseLabels(value.Get("dn").Str, "^topology/pod-[1-9][0-9]*/node-(?P<nodeid>[1-9][0-9]*)/")
+		if len(labels) == 0 {
+			return true
+		}
+		sviStates[labels["nodeid"]+"/"+value.Get("id").Str] = value.Get("operSt").Str
+		return true
+	})
+
+	metricDefinition := MetricDefinition{}
+	metricDefinition.Name = "svi_oper_state"
+	metricDefinition.Description = MetricDesc{
+		Help: "Returns 1 if the L3Out SVI is operational up on the node, else 0",
+		Type: "gauge",
+		Unit: "",
+	}
+
+	// The same SVI is used by all paths of the L3Out on a node with the same encap
+	seen := make(map[string]bool)
+	gjson.Get(paths, builtinPath("svi_status", "paths", "imdata.#.l3extRsPathL3OutAtt.attributes")).ForEach(func(key, value gjson.Result) bool {
+		l3out := parseLabels(value.Get("dn").Str, "^uni/tn-(?P<tenant>[^/]+)/out-(?P<l3out>[^/]+)/")
+		nodes := parseLabels(value.Get("tDn").Str, "^topology/pod-[1-9][0-9]*/(?:prot)?paths-(?P<nodeids>[1-9][0-9]*(?:-[1-9][0-9]*)?)/")
+		if len(l3out) == 0 || len(nodes) == 0 {
+			return true
+		}
+		encap := value.Get("encap").Str
+		for _, nodeid := range strings.Split(nodes["nodeids"], "-") {
+			key := fmt.Sprintf("%s/%s/%s/%s", l3out["tenant"], l3out["l3out"], nodeid, encap)
+			if seen[key] {
+				continue
+			}
+			vlan, ok := internalVlans[nodeid+"/"+encap]
+			if !ok {
+				// Not deployed on the node
+				continue
+			}
+			operSt, ok := sviStates[nodeid+"/vlan"+vlan]
+			if !ok {
+				continue
+			}
+			seen[key] = true
+
+			metric := Metric{}
+			metric.Labels = make(map[string]string)
+			metric.Labels["tenant"] = l3out["tenant"]
+			metric.Labels["l3out"] = l3out["l3out"]
+			metric.Labels["nodeid"] = nodeid
+			metric.Labels["encap"] = encap
+			if operSt == "up" {
+				metric.Value = 1
+			}
+			metricDefinition.Metrics = append(metricDefinition.Metrics, metric)
+		}
+		return true
+	})
+
+	ch <- []MetricDefinition{metricDefinition}
+}
+
+// tepPool return the size of the TEP pool of each pod and the number of addresses used by the TEP addresses of the
+// nodes. When the pool is exhausted no more nodes can be added to the pod
+func (p aciAPI) tepPool(ch chan []MetricDefinition) {
+	pools, err := p.queryer.getByClassQuery("fabricSetupP", "")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error("tep_pool not supported", err)
+		ch <- nil
+		return
+	}
+
+	nodes, err := p.queryer.getByClassQuery("topSystem", "")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error("tep_pool not supported", err)
+		ch <- nil
+		return
+	}
+
+	var addresses []net.IP
+	gjson.Get(nodes, builtinPath("tep_pool", "addresses", "imdata.#.topSystem.attributes.address")).ForEach(func(key, value gjson.Result) bool {
+		if ip := net.ParseIP(value.Str); ip != nil {
+			addresses = append(addresses, ip)
+		}
+		return true
+	})
+
+	metricDefinitionSize := MetricDefinition{}
+	metricDefinitionSize.Name = "tep_pool_size"
+	metricDefinitionSize.Description = MetricDesc{
+		Help: "Returns the number of addresses in the TEP pool of the pod",
+		Type: "gauge",
+		Unit: "",
+	}
+
+	metricDefinitionUsed := MetricDefinition{}
+	metricDefinitionUsed.Name = "tep_pool_used"
+	metricDefinitionUsed.Description = MetricDesc{
+		Help: "Returns the number of addresses in the TEP pool of the pod used by the nodes",
+		Type: "gauge",
+		Unit: "",
+	}
+
+	gjson.Get(pools, builtinPath("tep_pool", "pools", "imdata.#.fabricSetupP.attributes")).ForEach(func(key, value gjson.Result) bool {
+		_, pool, err := net.ParseCIDR(value.Get("tepPool").Str)
+		if err != nil {
+			return true
+		}
+		ones, bits := pool.Mask.Size()
+		used := 0
+		for _, ip := range addresses {
+			if pool.Contains(ip) {
+				used++
+			}
+		}
+
+		labels := map[string]string{"podid": value.Get("podId").Str, "pool": pool.String()}
+
+		metric := Metric{}
+		metric.Labels = labels
+		metric.Value = math.Pow(2, float64(bits-ones))
+		metricDefinitionSize.Metrics = append(metricDefinitionSize.Metrics, metric)
+
+		metric = Metric{}
+		metric.Labels = make(map[string]string)
+		for k, v := range labels {
+			metric.Labels[k] = v
+		}
+		metric.Value = float64(used)
+		metricDefinitionUsed.Metrics = append(metricDefinitionUsed.Metrics, metric)
+		return true
+	})
+
+	ch <- []MetricDefinition{metricDefinitionSize, metricDefinitionUsed}
+}
+
+// configChanges return the number of configuration changes from the id of the latest audit log record, that is
+// increased for every change. The rate of the counter is the configuration change rate of the fabric
+func (p aciAPI) configChanges(ch chan []MetricDefinition) {
+	data, err := p.queryer.getByClassQuery("aaaModLR", "?order-by=aaaModLR.id|desc&page-size=1")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error("config_changes not supported", err)
+		ch <- nil
+		return
+	}
+
+	metricDefinition := MetricDefinition{}
+	metricDefinition.Name = "config_change_events"
+	metricDefinition.Description = MetricDesc{
+		Help: "Returns the number of configuration changes recorded in the audit log",
+		Type: "counter",
+		Unit: "",
+	}
+
+	id := gjson.Get(data, builtinPath("config_changes", "id", "imdata.0.aaaModLR.attributes.id"))
+	if id.Exists() {
+		metric := Metric{}
+		metric.Labels = make(map[string]string)
+		metric.Value = p.toFloat(id.Str)
+		metricDefinition.Metrics = append(metricDefinition.Metrics, metric)
+	}
+
+	ch <- []MetricDefinition{metricDefinition}
+}
+
+// registrationStates are the registration states of a node, in the order they are reported
+var registrationStates = []string{"active", "inactive", "discovering", "undiscovered", "unsupported", "decommissioned",
+	"disabled", "maintenance"}
+
+// nodeRegistration return the registration state of all nodes the fabric has discovered, registered or not. The nodes
+// are found from the dhcp clients of the apic, and the state of the registered nodes is the fabric state of the fabric
+// node. Each state is reported as its own series, 1 for the current state of the node and 0 for the others. The apics
+// are only reported if include_controllers is set
+func (p aciAPI) nodeRegistration(ch chan []MetricDefinition) {
+	clients, err := p.queryer.getByClassQuery("dhcpClient", "")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error("node_registration not supported", err)
+		ch <- nil
+		return
+	}
+
+	nodes, err := p.queryer.getByClassQuery("fabricNode", "")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error("node_registration not supported", err)
+		ch <- nil
+		return
+	}
+
+	// The fabric state of each registered node id
+	fabricStates := make(map[string]string)
+	gjson.Get(nodes, builtinPath("node_registration", "nodes", "imdata.#.fabricNode.attributes")).ForEach(func(key, value gjson.Result) bool {
+		fabricStates[value.Get("id").Str] = value.Get("fabricSt").Str
+		return true
+	})
+
+	metricDefinition := MetricDefinition{}
+	metricDefinition.Name = "node_registration_state"
+	metricDefinition.Description = MetricDesc{
+		Help: "Returns 1 for the current registration state of the node, else 0",
+		Type: "gauge",
+		Unit: "",
+	}
+
+	includeControllers := viper.GetBool("include_controllers")
+	gjson.Get(clients, builtinPath("node_registration", "clients", "imdata.#.dhcpClient.attributes")).ForEach(func(key, value gjson.Result) bool {
+		if value.Get("nodeRole").Str == "controller" && !includeControllers {
+			return true
+		}
+		nodeID := value.Get("nodeId").Str
+		state, registered := fabricStates[nodeID]
+		if !registered {
+			if nodeID == "" || nodeID == "0" {
+				state = "undiscovered"
+			} else {
+				// A node id is assigned but the node is not yet a fabric node
+				state = "discovering"
+			}
+		}
+
+		states := registrationStates
+		if !contains(states, state) {
+			states = append(states[:len(states):len(states)], state)
+		}
+		for _, s := range states {
+			metric := Metric{}
+			metric.Labels = make(map[string]string)
+			metric.Labels["serial"] = value.Get("id").Str
+			metric.Labels["nodeid"] = nodeID
+			metric.Labels["name"] = value.Get("name").Str
+			metric.Labels["role"] = value.Get("nodeRole").Str
+			metric.Labels["state"] = s
+			if s == state {
+				metric.Value = 1
+			}
+			metricDefinition.Metrics = append(metricDefinition.Metrics, metric)
+		}
+		return true
+	})
+
+	ch <- []MetricDefinition{metricDefinition}
+}
+
+// mcpLoops return if a loop is detected by MCP, the MisCabling Protocol, on the interfaces of the leafs. MCP err-disable
+// the interface where the loop is detected, so a loop is an interface that is err-disabled by MCP. All interfaces with
+// MCP enabled, on a node with MCP enabled, are reported
+func (p aciAPI) mcpLoops(ch chan []MetricDefinition) {
+	instances, err := p.queryer.getByClassQuery("mcpInst", "")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error("mcp not supported", err)
+		ch <- nil
+		return
+	}
+
+	interfaces, err := p.queryer.getByClassQuery("mcpIf", "")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error("mcp not supported", err)
+		ch <- nil
+		return
+	}
+
+	disabled, err := p.queryer.getByClassQuery("ethpmPhysIf", "?query-target-filter=wcard(ethpmPhysIf.operErrDisQual,\"mcp\")")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error("mcp not supported", err)
+		ch <- nil
+		return
+	}
+
+	// The nodes where MCP is disabled, by <podid>/<nodeid>
+	disabledNodes := make(map[string]bool)
+	gjson.Get(instances, builtinPath("mcp", "instances", "imdata.#.mcpInst.attributes")).ForEach(func(key, value gjson.Result) bool {
+		labels := parseLabels(value.Get("dn").Str, "^topology/pod-(?P<podid>[1-9][0-9]*)/node-(?P<nodeid>[1-9][0-9]*)/")
+		if len(labels) > 0 && value.Get("adminSt").Str == "disabled" {
+			disabledNodes[labels["podid"]+"/"+labels["nodeid"]] = true
+		}
+		return true
+	})
+
+	// The interfaces err-disabled by MCP, by <podid>/<nodeid>/<interface>
+	loops := make(map[string]bool)
+	gjson.Get(disabled, builtinPath("mcp", "err_disabled", "imdata.#.ethpmPhysIf.attributes")).ForEach(func(key, value gjson.Result) bool {
+		labels := parseLabels(value.Get("dn").Str, "^topology/pod-(?P<podid>[1-9][0-9]*)/node-(?P<nodeid>[1-9][0-9]*)/sys/phys-\\[(?P<interface>[^\\]]+)\\]")
+		if len(labels) > 0 {
+			loops[labels["podid"]+"/"+labels["nodeid"]+"/"+labels["interface"]] = true
+		}
+		return true
+	})
+
+	metricDefinition := MetricDefinition{}
+	metricDefinition.Name = "mcp_loop_detected"
+	metricDefinition.Description = MetricDesc{
+		Help: "Returns 1 if MCP detected a loop and err-disabled the interface, else 0",
+		Type: "gauge",
+		Unit: "",
+	}
+
+	seen := make(map[string]bool)
+	addMetric := func(podid string, nodeid string, iface string) {
+		key := podid + "/" + nodeid + "/" + iface
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+		metric := Metric{}
+		metric.Labels = make(map[string]string)
+		metric.Labels["podid"] = podid
+		metric.Labels["nodeid"] = nodeid
+		metric.Labels["interface"] = iface
+		if loops[key] {
+			metric.Value = 1
+		}
+		metricDefinition.Metrics = append(metricDefinition.Metrics, metric)
+	}
+
+	gjson.Get(interfaces, builtinPath("mcp", "interfaces", "imdata.#.mcpIf.attributes")).ForEach(func(key, value gjson.Result) bool {
+		labels := parseLabels(value.Get("dn").Str, "^topology/pod-(?P<podid>[1-9][0-9]*)/node-(?P<nodeid>[1-9][0-9]*)/sys/mcp/inst/if-\\[(?P<interface>[^\\]]+)\\]")
+		if len(labels) == 0 || value.Get("adminSt").Str == "disabled" || disabledNodes[labels["podid"]+"/"+labels["nodeid"]] {
+			return true
+		}
+		addMetric(labels["podid"], labels["nodeid"], labels["interface"])
+		return true
+	})
+
+	// An interface err-disabled by MCP is always reported, also if MCP has been disabled after the loop
+	for key := range loops {
+		parts := strings.SplitN(key, "/", 3)
+		addMetric(parts[0], parts[1], parts[2])
+	}
+
+	ch <- []MetricDefinition{metricDefinition}
+}
+
+// epgDeployment return the number of endpoints of each EPG and the number of leafs the EPG is deployed on. All EPGs
+// are reported, so an EPG without endpoints or that failed to deploy is 0
+func (p aciAPI) epgDeployment(ch chan []MetricDefinition) {
+	epgs, err := p.queryer.getByClassQuery("fvAEPg", "?rsp-prop-include=naming-only")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error("epg_deployment not supported", err)
+		ch <- nil
+		return
+	}
+
+	endpoints, err := p.queryer.getByClassQuery("fvCEp", "?rsp-prop-include=naming-only")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error("epg_deployment not supported", err)
+		ch <- nil
+		return
+	}
+
+	locales, err := p.queryer.getByClassQuery("fvLocale", "?rsp-prop-include=naming-only")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error("epg_deployment not supported", err)
+		ch <- nil
+		return
+	}
+
+	// The endpoints are children of the EPG, uni/tn-<tenant>/ap-<app>/epg-<epg>/cep-<mac>
+	endpointCount := make(map[string]int)
+	gjson.Get(endpoints, builtinPath("epg_deployment", "endpoints", "imdata.#.fvCEp.attributes.dn")).ForEach(func(key, value gjson.Result) bool {
+		if i := strings.LastIndex(value.Str, "/cep-"); i > 0 {
+			endpointCount[value.Str[:i]]++
+		}
+		return true
+	})
+
+	// The nodes the EPG is deployed on, uni/epp/fv-[<epg dn>]/node-<nodeid>
+	nodeCount := make(map[string]int)
+	gjson.Get(locales, builtinPath("epg_deployment", "locales", "imdata.#.fvLocale.attributes.dn")).ForEach(func(key, value gjson.Result) bool {
+		labels := parseLabels(value.Str, "^uni/epp/fv-\\[(?P<epg>uni/tn-[^\\]]+)\\]/node-[1-9][0-9]*$")
+		if len(labels) > 0 {
+			nodeCount[labels["epg"]]++
+		}
+		return true
+	})
+
+	metricDefinitionEndpoints := MetricDefinition{}
+	metricDefinitionEndpoints.Name = "epg_endpoint_count"
+	metricDefinitionEndpoints.Description = MetricDesc{
+		Help: "Returns the number of endpoints learned in the EPG",
+		Type: "gauge",
+		Unit: "",
+	}
+
+	metricDefinitionNodes := MetricDefinition{}
+	metricDefinitionNodes.Name = "epg_deployed_node_count"
+	metricDefinitionNodes.Description = MetricDesc{
+		Help: "Returns the number of leafs the EPG is deployed on",
+		Type: "gauge",
+		Unit: "",
+	}
+
+	gjson.Get(epgs, builtinPath("epg_deployment", "epgs", "imdata.#.fvAEPg.attributes.dn")).ForEach(func(key, value gjson.Result) bool {
+		labels := parseLabels(value.Str, "^uni/tn-(?P<tenant>[^/]+)/ap-(?P<app>[^/]+)/epg-(?P<epg>[^/]+)$")
+		if len(labels) == 0 {
+			return true
+		}
+
+		metric := Metric{}
+		metric.Labels = make(map[string]string)
+		metric.Labels["tenant"] = labels["tenant"]
+		metric.Labels["app"] = labels["app"]
+		metric.Labels["epg"] = labels["epg"]
+		metric.Value = float64(endpointCount[value.Str])
+		metricDefinitionEndpoints.Metrics = append(metricDefinitionEndpoints.Metrics, metric)
+
+		metric = Metric{}
+		metric.Labels = make(map[string]string)
+		metric.Labels["tenant"] = labels["tenant"]
+		metric.Labels["app"] = labels["app"]
+		metric.Labels["epg"] = labels["epg"]
+		metric.Value = float64(nodeCount[value.Str])
+		metricDefinitionNodes.Metrics = append(metricDefinitionNodes.Metrics, metric)
+		return true
+	})
+
+	ch <- []MetricDefinition{metricDefinitionEndpoints, metricDefinitionNodes}
+}
+
+// fabricTopology return the number of leafs per spine of each pod and the number of uplinks from each leaf to the
+// spines, for the capacity planning of the fabric. The uplinks are the fabric links discovered between the leafs and
+// the spines, each leaf port is counted once
+func (p aciAPI) fabricTopology(ch chan []MetricDefinition) {
+	nodes, err := p.queryer.getByClassQuery("fabricNode", "")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error("fabric_topology not supported", err)
+		ch <- nil
+		return
+	}
+
+	links, err := p.queryer.getByClassQuery("fabricLink", "")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error("fabric_topology not supported", err)
+		ch <- nil
+		return
+	}
+
+	type podRole struct {
+		podid string
+		role  string
+	}
+	roleCount := make(map[podRole]int)
+	// The role and pod of each node id
+	roles := make(map[string]string)
+	pods := make(map[string]string)
+	gjson.Get(nodes, builtinPath("fabric_topology", "nodes", "imdata.#.fabricNode.attributes")).ForEach(func(key, value gjson.Result) bool {
+		labels := parseLabels(value.Get("dn").Str, "^topology/pod-(?P<podid>[1-9][0-9]*)/node-(?P<nodeid>[1-9][0-9]*)$")
+		if len(labels) == 0 {
+			return true
+		}
+		role := value.Get("role").Str
+		roles[labels["nodeid"]] = role
+		pods[labels["nodeid"]] = labels["podid"]
+		roleCount[podRole{podid: labels["podid"], role: role}]++
+		return true
+	})
+
+	// The leaf ports with a link to a spine, by leaf node id
+	uplinks := make(map[string]map[string]bool)
+	gjson.Get(links, builtinPath("fabric_topology", "links", "imdata.#.fabricLink.attributes")).ForEach(func(key, value gjson.Result) bool {
+		leaf, slot, port := value.Get("n1").Str, value.Get("s1").Str, value.Get("p1").Str
+		spine := value.Get("n2").Str
+		if roles[leaf] != "leaf" {
+			leaf, slot, port = value.Get("n2").Str, value.Get("s2").Str, value.Get("p2").Str
+			spine = value.Get("n1").Str
+		}
+		if roles[leaf] != "leaf" || roles[spine] != "spine" {
+			return true
+		}
+		if _, ok := uplinks[leaf]; !ok {
+			uplinks[leaf] = make(map[string]bool)
+		}
+		uplinks[leaf][slot+"/"+port] = true
+		return true
+	})
+
+	metricDefinitionRatio := MetricDefinition{}
+	metricDefinitionRatio.Name = "fabric_leafs_per_spine"
+	metricDefinitionRatio.Description = MetricDesc{
+		Help: "Returns the number of leafs per spine of the pod",
+		Type: "gauge",
+		Unit: "",
+	}
+	for key, spines := range roleCount {
+		if key.role != "spine" || spines == 0 {
+			continue
+		}
+		metric := Metric{}
+		metric.Labels = make(map[string]string)
+		metric.Labels["podid"] = key.podid
+		metric.Value = roundPrecision(float64(roleCount[podRole{podid: key.podid, role: "leaf"}]) / float64(spines))
+		metricDefinitionRatio.Metrics = append(metricDefinitionRatio.Metrics, metric)
+	}
+
+	metricDefinitionUplinks := MetricDefinition{}
+	metricDefinitionUplinks.Name = "fabric_leaf_uplinks"
+	metricDefinitionUplinks.Description = MetricDesc{
+		Help: "Returns the number of uplinks from the leaf to the spines",
+		Type: "gauge",
+		Unit: "",
+	}
+	// All leafs, so a leaf without uplinks is 0
+	for nodeid, role := range roles {
+		if role != "leaf" {
+			continue
+		}
+		metric := Metric{}
+		metric.Labels = make(map[string]string)
+		metric.Labels["podid"] = pods[nodeid]
+		metric.Labels["nodeid"] = nodeid
+		metric.Value = float64(len(uplinks[nodeid]))
+		metricDefinitionUplinks.Metrics = append(metricDefinitionUplinks.Metrics, metric)
+	}
+
+	ch <- []MetricDefinition{metricDefinitionRatio, metricDefinitionUplinks}
+}
+
+// endpointScale return the number of endpoints of the fabric as a ratio of the max number of endpoints of the
+// hardware generation of the fabric, so the scale can be alerted on like a health score. The max numbers are
+// configured by generation in builtin_queries.endpoint_scale.max_endpoints, and the generation of the fabric by
+// hardware_generation of the fabric profile. A fabric without a generation does not execute the query
+func (p aciAPI) endpointScale(ch chan []MetricDefinition) {
+	generation := p.connection.fabricConfig.HardwareGeneration
+	maxEndpoints := viper.GetFloat64(fmt.Sprintf("builtin_queries.endpoint_scale.max_endpoints.%s", generation))
+	if maxEndpoints <= 0 {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error(fmt.Sprintf("endpoint_scale has no max endpoints for the generation %s", generation))
+		ch <- nil
+		return
+	}
+
+	data, err := p.queryer.getByClassQuery("fvCEp", "?rsp-subtree-include=count")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error("endpoint_scale not supported", err)
+		ch <- nil
+		return
+	}
+
+	endpoints := p.toFloat(gjson.Get(data, builtinPath("endpoint_scale", "count", "imdata.0.moCount.attributes.count")).Str)
+
+	metricDefinition := MetricDefinition{}
+	metricDefinition.Name = "fabric_endpoint_scale"
+	metricDefinition.Description = MetricDesc{
+		Help: "Returns the number of endpoints of the fabric as a ratio of the max endpoints of the hardware generation",
+		Type: "gauge",
+		Unit: "ratio",
+	}
+
+	metric := Metric{}
+	metric.Labels = make(map[string]string)
+	metric.Value = roundPrecision(endpoints / maxEndpoints)
+	metricDefinition.Metrics = []Metric{metric}
+
+	ch <- []MetricDefinition{metricDefinition}
+}
+
+// faultAge return the age of the oldest critical fault that is not acknowledged, so a critical fault that is left
+// open can be alerted on, not only the number of faults. The age is 0 if there are no unacknowledged critical faults
+func (p aciAPI) faultAge(ch chan []MetricDefinition) {
+	// Only the oldest fault is needed
+	data, err := p.queryer.getByClassQuery("faultInst",
+		"?query-target-filter=and(eq(faultInst.severity,\"critical\"),eq(faultInst.ack,\"no\"))&order-by=faultInst.created|asc&page-size=1")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error("fault_age not supported", err)
+		ch <- nil
+		return
+	}
+
+	oldest := 0.0
+	gjson.Get(data, builtinPath("fault_age", "created", "imdata.#.faultInst.attributes.created")).ForEach(func(key, value gjson.Result) bool {
+		created := p.toFloat(value.Str)
+		if created > 0 && (oldest == 0 || created < oldest) {
+			oldest = created
+		}
+		return true
+	})
+
+	metricDefinition := MetricDefinition{}
+	metricDefinition.Name = "oldest_unacked_critical_fault_age"
+	metricDefinition.Description = MetricDesc{
+		Help: "Returns the number of seconds since the oldest critical fault that is not acknowledged was created",
+		Type: "gauge",
+		Unit: "seconds",
+	}
+
+	metric := Metric{}
+	metric.Labels = make(map[string]string)
+	if oldest > 0 {
+		metric.Value = roundPrecision(float64(time.Now().Unix()) - oldest)
+	}
+	metricDefinition.Metrics = []Metric{metric}
+
+	ch <- []MetricDefinition{metricDefinition}
+}
+
+// podEnvironment return the power drawn by the power supplies and the number of operational fan trays of each pod, a
+// rollup of the equipment of the nodes that can be compared with the readings of the rack power distribution. The
+// power is the last drawn power of the power supply stats, in watts
+func (p aciAPI) podEnvironment(ch chan []MetricDefinition) {
+	power, err := p.queryer.getByClassQuery("eqptPsPower5min", "")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error("pod_environment not supported", err)
+		ch <- nil
+		return
+	}
+
+	fans, err := p.queryer.getByClassQuery("eqptFt", "")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error("pod_environment not supported", err)
+		ch <- nil
+		return
+	}
+
+	podPower := make(map[string]float64)
+	gjson.Get(power, builtinPath("pod_environment", "power", "imdata.#.eqptPsPower5min.attributes")).ForEach(func(key, value gjson.Result) bool {
+		labels := parseLabels(value.Get("dn").Str, "^topology/pod-(?P<podid>[1-9][0-9]*)/node-[1-9][0-9]*/")
+		if len(labels) == 0 {
+			return true
+		}
+		podPower[labels["podid"]] += p.toFloat(value.Get(builtinPath("pod_environment", "drawn", "drawnLast")).Str)
+		return true
+	})
+
+	podFans := make(map[string]int)
+	gjson.Get(fans, builtinPath("pod_environment", "fans", "imdata.#.eqptFt.attributes")).ForEach(func(key, value gjson.Result) bool {
+		labels := parseLabels(value.Get("dn").Str, "^topology/pod-(?P<podid>[1-9][0-9]*)/node-[1-9][0-9]*/")
+		if len(labels) == 0 {
+			return true
+		}
+		// Include the pods where all fan trays have failed
+		if _, ok := podFans[labels["podid"]]; !ok {
+			podFans[labels["podid"]] = 0
+		}
+		if value.Get("operSt").Str == "ok" {
+			podFans[labels["podid"]]++
+		}
+		return true
+	})
+
+	metricDefinitionPower := MetricDefinition{}
+	metricDefinitionPower.Name = "pod_total_power"
+	metricDefinitionPower.Description = MetricDesc{
+		Help: "Returns the power drawn by all power supplies of the nodes of the pod",
+		Type: "gauge",
+		Unit: "watts",
+	}
+	for podid, watts := range podPower {
+		metric := Metric{}
+		metric.Labels = make(map[string]string)
+		metric.Labels["podid"] = podid
+		metric.Value = roundPrecision(watts)
+		metricDefinitionPower.Metrics = append(metricDefinitionPower.Metrics, metric)
+	}
+
+	metricDefinitionFans := MetricDefinition{}
+	metricDefinitionFans.Name = "pod_fan_count"
+	metricDefinitionFans.Description = MetricDesc{
+		Help: "Returns the number of operational fan trays of the nodes of the pod",
+		Type: "gauge",
+		Unit: "",
+	}
+	for podid, count := range podFans {
+		metric := Metric{}
+		metric.Labels = make(map[string]string)
+		metric.Labels["podid"] = podid
+		metric.Value = float64(count)
+		metricDefinitionFans.Metrics = append(metricDefinitionFans.Metrics, metric)
+	}
+
+	ch <- []MetricDefinition{metricDefinitionPower, metricDefinitionFans}
+}
+
+// firmwareUpgradeRunning are the upgrade status of a node upgrade job that is not done
+var firmwareUpgradeRunning = []string{"scheduled", "inqueue", "inprogress", "waitonbootup", "inretryqueue"}
+
+// firmwareUpgradeFailed are the upgrade status of a node upgrade job that failed
+var firmwareUpgradeFailed = []string{"completenok", "incompatible"}
+
+// firmwareUpgrade return the number of nodes with an upgrade in progress and the number of nodes where the last upgrade
+// failed, from the upgrade job of each node. During a planned upgrade the health alerts can be suppressed, and an
+// upgrade that fail or never finish can be alerted on
+func (p aciAPI) firmwareUpgrade(ch chan []MetricDefinition) {
+	data, err := p.queryer.getByClassQuery("maintUpgJob", "")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error("firmware_upgrade not supported", err)
+		ch <- nil
+		return
+	}
+
+	running := 0
+	failed := 0
+	gjson.Get(data, builtinPath("firmware_upgrade", "jobs", "imdata.#.maintUpgJob.attributes.upgradeStatus")).ForEach(func(key, value gjson.Result) bool {
+		switch {
+		case contains(firmwareUpgradeRunning, value.Str):
+			running++
+		case contains(firmwareUpgradeFailed, value.Str):
+			failed++
+		}
+		return true
+	})
+
+	metricDefinitionRunning := MetricDefinition{}
+	metricDefinitionRunning.Name = "firmware_upgrade_in_progress"
+	metricDefinitionRunning.Description = MetricDesc{
+		Help: "Returns the number of nodes with a firmware upgrade that is scheduled or in progress",
+		Type: "gauge",
+		Unit: "",
+	}
+	metric := Metric{}
+	metric.Labels = make(map[string]string)
+	metric.Value = float64(running)
+	metricDefinitionRunning.Metrics = []Metric{metric}
+
+	metricDefinitionFailed := MetricDefinition{}
+	metricDefinitionFailed.Name = "firmware_upgrade_failed"
+	metricDefinitionFailed.Description = MetricDesc{
+		Help: "Returns the number of nodes where the last firmware upgrade failed",
+		Type: "gauge",
+		Unit: "",
+	}
+	metric = Metric{}
+	metric.Labels = make(map[string]string)
+	metric.Value = float64(failed)
+	metricDefinitionFailed.Metrics = []Metric{metric}
+
+	ch <- []MetricDefinition{metricDefinitionRunning, metricDefinitionFailed}
+}
+
+// interfaceMtu return the operational mtu of each physical interface and if it differs from the configured mtu of the
+// interface, from the layer 1 policy of the interface, l1PhysIf, and the operational state, ethpmPhysIf. An interface
+// configured to inherit the mtu is compared with builtin_queries.interface_mtu.inherit_mtu, the mtu of the fabric
+func (p aciAPI) interfaceMtu(ch chan []MetricDefinition) {
+	configured, err := p.queryer.getByClassQuery("l1PhysIf", "")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error("interface_mtu not supported", err)
+		ch <- nil
+		return
+	}
+
+	operational, err := p.queryer.getByClassQuery("ethpmPhysIf", "")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error("interface_mtu not supported", err)
+		ch <- nil
+		return
+	}
+
+	interfaceRegex := "^topology/pod-(?P<podid>[1-9][0-9]*)/node-(?P<nodeid>[1-9][0-9]*)/sys/phys-\\[(?P<interface>[^\\]]+)\\]"
+
+	// The configured mtu by <podid>/<nodeid>/<interface>
+	configuredMtu := make(map[string]float64)
+	gjson.Get(configured, builtinPath("interface_mtu", "configured", "imdata.#.l1PhysIf.attributes")).ForEach(func(key, value gjson.Result) bool {
+		labels := parseLabels(value.Get("dn").Str, interfaceRegex)
+		if len(labels) == 0 {
+			return true
+		}
+		mtu := value.Get(builtinPath("interface_mtu", "mtu", "mtu")).Str
+		if mtu == "inherit" {
+			configuredMtu[labels["podid"]+"/"+labels["nodeid"]+"/"+labels["interface"]] = viper.GetFloat64("builtin_queries.interface_mtu.inherit_mtu")
+		} else {
+			configuredMtu[labels["podid"]+"/"+labels["nodeid"]+"/"+labels["interface"]] = p.toFloat(mtu)
+		}
+		return true
+	})
+
+	metricDefinitionMtu := MetricDefinition{}
+	metricDefinitionMtu.Name = "interface_mtu"
+	metricDefinitionMtu.Description = MetricDesc{
+		Help: "Returns the operational mtu of the interface",
+		Type: "gauge",
+		Unit: "bytes",
+	}
+
+	metricDefinitionMismatch := MetricDefinition{}
+	metricDefinitionMismatch.Name = "interface_mtu_mismatch"
+	metricDefinitionMismatch.Description = MetricDesc{
+		Help: "Returns 1 if the operational mtu of the interface differs from the configured mtu, else 0",
+		Type: "gauge",
+		Unit: "",
+	}
+
+	gjson.Get(operational, builtinPath("interface_mtu", "operational", "imdata.#.ethpmPhysIf.attributes")).ForEach(func(key, value gjson.Result) bool {
+		labels := parseLabels(value.Get("dn").Str, interfaceRegex)
+		if len(labels) == 0 {
+			return true
+		}
+		operMtu := value.Get(builtinPath("interface_mtu", "oper_mtu", "operMtu"))
+		if !operMtu.Exists() {
+			return true
+		}
+
+		metric := Metric{}
+		metric.Labels = labels
+		metric.Value = p.toFloat(operMtu.Str)
+		metricDefinitionMtu.Metrics = append(metricDefinitionMtu.Metrics, metric)
+
+		// An interface without a layer 1 policy has nothing to compare with
+		mtu, ok := configuredMtu[labels["podid"]+"/"+labels["nodeid"]+"/"+labels["interface"]]
+		if !ok {
+			return true
+		}
+		mismatch := Metric{}
+		mismatch.Labels = make(map[string]string)
+		for k, v := range labels {
+			mismatch.Labels[k] = v
+		}
+		if mtu != metric.Value {
+			mismatch.Value = 1
+		}
+		metricDefinitionMismatch.Metrics = append(metricDefinitionMismatch.Metrics, mismatch)
+		return true
+	})
+
+	ch <- []MetricDefinition{metricDefinitionMtu, metricDefinitionMismatch}
+}
+
+// contractHits return the number of packets that hit the zoning rules of the contracts, by the action of the rule and
+// the source and destination EPG, on each node. The EPGs are resolved from the pcTag and vrf scope of the rule, by the
+// EPGs and external EPGs of the fabric. A pcTag without an EPG, like the reserved pcTags of the fabric, is the label
+// value. The hits of the rules with the same action and EPGs on a node, like the rules of different filters, are summed
+func (p aciAPI) contractHits(ch chan []MetricDefinition) {
+	rules, err := p.queryer.getByClassQuery("actrlRule", "?rsp-subtree=children&rsp-subtree-class=actrlRuleHit5min")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error("contract_hits not supported", err)
+		ch <- nil
+		return
+	}
+
+	// The EPG dn by <scope>/<pcTag>, where a global pcTag, below 16384 and used by shared services, is also added by
+	// <pcTag>
+	epgs := make(map[string]string)
+	for name, class := range map[string]string{"epgs": "fvAEPg", "external_epgs": "l3extInstP"} {
+		data, err := p.queryer.getByClassQuery(class, "")
+		if err != nil {
+			log.WithFields(log.Fields{
+				"requestid": p.ctx.Value("requestid"),
+				"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+			}).Error("contract_hits not supported", err)
+			ch <- nil
+			return
+		}
+		gjson.Get(data, builtinPath("contract_hits", name, fmt.Sprintf("imdata.#.%s.attributes", class))).ForEach(func(key, value gjson.Result) bool {
+			pcTag := value.Get("pcTag").Str
+			if pcTag == "" || pcTag == "any" {
+				return true
+			}
+			epgs[value.Get("scope").Str+"/"+pcTag] = value.Get("dn").Str
+			if p.toFloat(pcTag) < 16384 {
+				epgs[pcTag] = value.Get("dn").Str
+			}
+			return true
+		})
+	}
+
+	epgName := func(scope string, pcTag string) string {
+		if dn, ok := epgs[scope+"/"+pcTag]; ok {
+			return dn
+		}
+		if dn, ok := epgs[pcTag]; ok {
+			return dn
+		}
+		return pcTag
+	}
+
+	type ruleKey struct {
+		podid       string
+		nodeid      string
+		action      string
+		source      string
+		destination string
+	}
+	hits := make(map[ruleKey]float64)
+	gjson.Get(rules, builtinPath("contract_hits", "rules", "imdata.#.actrlRule")).ForEach(func(key, value gjson.Result) bool {
+		attributes := value.Get("attributes")
+		labels := parseLabels(attributes.Get("dn").Str, "^topology/pod-(?P<podid>[1-9][0-9]*)/node-(?P<nodeid>[1-9][0-9]*)/")
+		if len(labels) == 0 {
+			return true
+		}
+		packets := value.Get(builtinPath("contract_hits", "hits", "children.#.actrlRuleHit5min.attributes.pktsCum"))
+		if len(packets.Array()) == 0 {
+			return true
+		}
+		scope := attributes.Get("scopeId").Str
+		rule := ruleKey{
+			podid:       labels["podid"],
+			nodeid:      labels["nodeid"],
+			action:      attributes.Get("action").Str,
+			source:      epgName(scope, attributes.Get("sPcTag").Str),
+			destination: epgName(scope, attributes.Get("dPcTag").Str),
+		}
+		for _, pkts := range packets.Array() {
+			hits[rule] += p.toFloat(pkts.Str)
+		}
+		return true
+	})
+
+	metricDefinition := MetricDefinition{}
+	metricDefinition.Name = "contract_rule_hits"
+	metricDefinition.Description = MetricDesc{
+		Help: "Returns the number of packets that hit the contract rules with the action between the EPGs on the node",
+		Type: "counter",
+		Unit: "",
+	}
+
+	for rule, packets := range hits {
+		metric := Metric{}
+		metric.Labels = make(map[string]string)
+		metric.Labels["podid"] = rule.podid
+		metric.Labels["nodeid"] = rule.nodeid
+		metric.Labels["action"] = rule.action
+		metric.Labels["source_epg"] = rule.source
+		metric.Labels["destination_epg"] = rule.destination
+		metric.Value = packets
+		metricDefinition.Metrics = append(metricDefinition.Metrics, metric)
+	}
+
+	ch <- []MetricDefinition{metricDefinition}
+}
+
+// fabricDrops return the number of packets dropped per second by all physical interfaces of the fabric, the sum of the
+// drop rates of the ingress and egress drop counters of each interface. The rate is the drops during the 5 minute stats
+// interval divided by its elapsed time. Port channels are not included, since their drops are the drops of the member
+// interfaces. The counters included are builtin_queries.fabric_drops.ingress_counters and egress_counters
+func (p aciAPI) fabricDrops(ch chan []MetricDefinition) {
+	directions := []struct {
+		name     string
+		class    string
+		counters []string
+	}{
+		{"ingress", "eqptIngrDropPkts5min", viper.GetStringSlice("builtin_queries.fabric_drops.ingress_counters")},
+		{"egress", "eqptEgrDropPkts5min", viper.GetStringSlice("builtin_queries.fabric_drops.egress_counters")},
+	}
+
+	drops := 0.0
+	for _, direction := range directions {
+		data, err := p.queryer.getByClassQuery(direction.class, "")
+		if err != nil {
+			log.WithFields(log.Fields{
+				"requestid": p.ctx.Value("requestid"),
+				"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+			}).Error("fabric_drops not supported", err)
+			ch <- nil
+			return
+		}
+
+		gjson.Get(data, builtinPath("fabric_drops", direction.name, fmt.Sprintf("imdata.#.%s.attributes", direction.class))).ForEach(func(key, value gjson.Result) bool {
+			if !strings.Contains(value.Get("dn").Str, "/sys/phys-[") {
+				return true
+			}
+			for _, counter := range direction.counters {
+				drops += p.toFloat(value.Get(counter + "Rate").Str)
+			}
+			return true
+		})
+	}
+
+	metricDefinition := MetricDefinition{}
+	metricDefinition.Name = "fabric_total_drops"
+	metricDefinition.Description = MetricDesc{
+		Help: "Returns the number of packets dropped per second by all physical interfaces of the fabric",
+		Type: "gauge",
+		Unit: "per_second",
+	}
+	metric := Metric{}
+	metric.Labels = make(map[string]string)
+	metric.Value = roundPrecision(drops)
+	metricDefinition.Metrics = []Metric{metric}
+
+	ch <- []MetricDefinition{metricDefinition}
+}
+
+// bgpRoutes return the number of routes in the BGP table of each vrf on each node, from a count of the bgpRoute objects
+// of the BGP domain of the vrf. Each domain is a query to the apic, so the query time grow with the number of nodes and
+// vrfs
+func (p aciAPI) bgpRoutes(ch chan []MetricDefinition) {
+	domains, err := p.queryer.getByClassQuery("bgpDom", "")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error("bgp_routes not supported", err)
+		ch <- nil
+		return
+	}
+
+	metricDefinition := MetricDefinition{}
+	metricDefinition.Name = "bgp_route_count"
+	metricDefinition.Description = MetricDesc{
+		Help: "Returns the number of routes in the BGP table of the vrf on the node",
+		Type: "gauge",
+		Unit: "",
+	}
+
+	failed := false
+	gjson.Get(domains, builtinPath("bgp_routes", "domains", "imdata.#.bgpDom.attributes")).ForEach(func(key, value gjson.Result) bool {
+		labels := parseLabels(value.Get("dn").Str, "^topology/pod-(?P<podid>[1-9][0-9]*)/node-(?P<nodeid>[1-9][0-9]*)/")
+		if len(labels) == 0 {
+			return true
+		}
+		data, err := p.queryer.getByDnQuery(value.Get("dn").Str, "?query-target=subtree&target-subtree-class=bgpRoute&rsp-subtree-include=count")
+		if err != nil {
+			failed = true
+			return false
+		}
+		labels["vrf"] = value.Get("name").Str
+		metric := Metric{}
+		metric.Labels = labels
+		metric.Value = p.toFloat(gjson.Get(data, builtinPath("bgp_routes", "route_count", "imdata.0.moCount.attributes.count")).Str)
+		metricDefinition.Metrics = append(metricDefinition.Metrics, metric)
+		return true
+	})
+
+	if failed {
+		ch <- nil
+		return
+	}
+
+	ch <- []MetricDefinition{metricDefinition}
+}
+
+// epgDomains return if the association of each EPG to a domain, like a VMM or physical domain, is deployed, from the
+// state and the configuration issues of the relation, fvRsDomAtt. A broken VMM domain association can put the virtual
+// machines in the wrong EPG
+func (p aciAPI) epgDomains(ch chan []MetricDefinition) {
+	data, err := p.queryer.getByClassQuery("fvRsDomAtt", "")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error("epg_domains not supported", err)
+		ch <- nil
+		return
+	}
+
+	metricDefinition := MetricDefinition{}
+	metricDefinition.Name = "epg_domain_association_state"
+	metricDefinition.Description = MetricDesc{
+		Help: "Returns 1 if the association of the EPG to the domain is formed without configuration issues, else 0",
+		Type: "gauge",
+		Unit: "",
+	}
+
+	gjson.Get(data, builtinPath("epg_domains", "associations", "imdata.#.fvRsDomAtt.attributes")).ForEach(func(key, value gjson.Result) bool {
+		labels := parseLabels(value.Get("dn").Str, "^uni/tn-(?P<tenant>[^/]+)/ap-(?P<app>[^/]+)/epg-(?P<epg>[^/]+)/rsdomAtt-")
+		if len(labels) == 0 {
+			return true
+		}
+		labels["domain"] = value.Get("tDn").Str
+		labels["class"] = value.Get("tCl").Str
+
+		metric := Metric{}
+		metric.Labels = labels
+		if value.Get("state").Str == "formed" && value.Get("configIssues").Str == "" {
+			metric.Value = 1
+		}
+		metricDefinition.Metrics = append(metricDefinition.Metrics, metric)
+		return true
+	})
+
+	ch <- []MetricDefinition{metricDefinition}
+}
+
+// nodeTimeDrift return the difference in seconds between the current time of each node and the time of the apic with
+// the lowest node id, from the currentTime of topSystem. A positive drift is a node ahead of the apic. The topSystem
+// response is shared with the other built-in queries of the scrape that query all nodes. The apics are only reported
+// if include_controllers is set, but are always used as the reference time
+func (p aciAPI) nodeTimeDrift(ch chan []MetricDefinition) {
+	nodes, err := p.queryer.getByClassQuery("topSystem", "")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error("node_time_drift not supported", err)
+		ch <- nil
+		return
+	}
+
+	type nodeTime struct {
+		labels map[string]string
+		time   time.Time
+	}
+	includeControllers := viper.GetBool("include_controllers")
+	var nodeTimes []nodeTime
+	var apicTime time.Time
+	apicID := 0.0
+	gjson.Get(nodes, builtinPath("node_time_drift", "nodes", "imdata.#.topSystem.attributes")).ForEach(func(key, value gjson.Result) bool {
+		labels := parseLabels(value.Get("dn").Str, "^topology/pod-(?P<podid>[1-9][0-9]*)/node-(?P<nodeid>[1-9][0-9]*)/")
+		currentTime, err := time.Parse(time.RFC3339Nano, value.Get(builtinPath("node_time_drift", "current_time", "currentTime")).Str)
+		if len(labels) == 0 || err != nil {
+			return true
+		}
+		controller := value.Get("role").Str == "controller"
+		if !controller || includeControllers {
+			nodeTimes = append(nodeTimes, nodeTime{labels: labels, time: currentTime})
+		}
+		if id := p.toFloat(labels["nodeid"]); controller && (apicID == 0 || id < apicID) {
+			apicID = id
+			apicTime = currentTime
+		}
+		return true
+	})
+
+	// Without an apic there is no time to compare with
+	if apicID == 0 {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error("node_time_drift found no apic current time")
+		ch <- nil
+		return
+	}
+
+	metricDefinition := MetricDefinition{}
+	metricDefinition.Name = "node_time_drift"
+	metricDefinition.Description = MetricDesc{
+		Help: "Returns the difference between the current time of the node and the time of the apic",
+		Type: "gauge",
+		Unit: "seconds",
+	}
+
+	for _, node := range nodeTimes {
+		metric := Metric{}
+		metric.Labels = node.labels
+		metric.Value = roundPrecision(node.time.Sub(apicTime).Seconds())
+		metricDefinition.Metrics = append(metricDefinition.Metrics, metric)
+	}
+
+	ch <- []MetricDefinition{metricDefinition}
+}
+
+// nodeFaults return the number of faults of each node by severity, from the dn of the faults, so the nodes that raise
+// the faults are found. The severities are labeled and selected as for the faults built-in query, by
+// builtin_queries.faults.severities. A node with any fault has a count for all severities, so the series do not come
+// and go with the faults of a severity. The apics are only reported if include_controllers is set
+func (p aciAPI) nodeFaults(ch chan []MetricDefinition) {
+	data, err := p.queryer.getByClassQuery("faultInst", "?query-target-filter=wcard(faultInst.dn,\"^topology/pod-\")")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error(fmt.Sprintf("node_faults not supported - %s", err))
+		ch <- nil
+		return
+	}
+
+	controllers, err := p.excludedControllers()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error(fmt.Sprintf("node_faults not supported - %s", err))
+		ch <- nil
+		return
+	}
+
+	severities := viper.GetStringSlice("builtin_queries.faults.severities")
+
+	// The fault count by severity by <podid>/<nodeid>
+	nodes := make(map[string]map[string]int)
+	gjson.Get(data, builtinPath("node_faults", "faults", "imdata.#.faultInst.attributes")).ForEach(func(key, value gjson.Result) bool {
+		labels := parseLabels(value.Get("dn").Str, "^topology/pod-(?P<podid>[1-9][0-9]*)/node-(?P<nodeid>[1-9][0-9]*)/")
+		if len(labels) == 0 {
+			return true
+		}
+		node := labels["podid"] + "/" + labels["nodeid"]
+		if _, ok := nodes[node]; !ok {
+			nodes[node] = make(map[string]int)
+		}
+		if severity, ok := faultSeverities[value.Get("severity").Str]; ok && contains(severities, severity) {
+			nodes[node][severity]++
+		}
+		return true
+	})
+
+	metricDefinition := MetricDefinition{}
+	metricDefinition.Name = "node_fault_count"
+	metricDefinition.Description = MetricDesc{
+		Help: "Returns the number of faults of the node by severity",
+		Type: "gauge",
+		Unit: "",
+	}
+
+	for node, counts := range nodes {
+		parts := strings.SplitN(node, "/", 2)
+		for _, severity := range severities {
+			metric := Metric{}
+			metric.Labels = make(map[string]string)
+			metric.Labels["podid"] = parts[0]
+			metric.Labels["nodeid"] = parts[1]
+			metric.Labels["severity"] = severity
+			metric.Value = float64(counts[severity])
+			metricDefinition.Metrics = append(metricDefinition.Metrics, metric)
+		}
+	}
+	metricDefinition.Metrics = withoutControllers(metricDefinition.Metrics, controllers)
+
+	ch <- []MetricDefinition{metricDefinition}
+}
@@ -16,11 +16,16 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"html"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/cookiejar"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -37,6 +42,21 @@ var responseTime = promauto.NewHistogramVec(prometheus.HistogramOpts{
 	[]string{"fabric", "class", "method", "status"},
 )
 
+var requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    MetricsPrefix + "apic_request_duration_seconds",
+	Help:    "Histogram of the time (in seconds) the requests to the apic of a query took to complete.",
+	Buckets: []float64{0.050, 0.100, 0.200, 0.500, 1.0, 2.0, 3.0, 4.0, 5.0, 6.0},
+},
+	[]string{"fabric", "query"},
+)
+
+// liveConnections hold the connections that are logged in to an apic, so they can be logged out on shutdown. The
+// connections are keyed by their active controller pointer, that is unique for each connection
+var liveConnections = struct {
+	sync.Mutex
+	connections map[*int]AciConnection
+}{connections: make(map[*int]AciConnection)}
+
 // AciConnection is the connection object
 type AciConnection struct {
 	ctx              context.Context
@@ -46,6 +66,7 @@ type AciConnection struct {
 	Headers          map[string]string
 	Client           http.Client
 	responseTime     *prometheus.HistogramVec
+	maxResponseSize  int64
 }
 
 func newAciConnction(ctx context.Context, fabricConfig Fabric) *AciConnection {
@@ -53,21 +74,33 @@ func newAciConnction(ctx context.Context, fabricConfig Fabric) *AciConnection {
 	jar, _ := cookiejar.New(nil)
 
 	var httpClient = HTTPClient{
-		InsecureHTTPS:       viper.GetBool("httpclient.insecureHTTPS"),
-		Timeout:             viper.GetInt("httpclient.timeout"),
-		Keepalive:           viper.GetInt("httpclient.keepalive"),
-		Tlshandshaketimeout: viper.GetInt("httpclient.tlshandshaketimeout"),
-		cookieJar:           jar,
+		InsecureHTTPS:         viper.GetBool("httpclient.insecureHTTPS"),
+		Timeout:               viper.GetInt("httpclient.timeout"),
+		Keepalive:             viper.GetInt("httpclient.keepalive"),
+		Tlshandshaketimeout:   viper.GetInt("httpclient.tlshandshaketimeout"),
+		ResponseHeaderTimeout: viper.GetInt("httpclient.response_header_timeout"),
+		MaxIdleConns:          viper.GetInt("httpclient.maxidleconns"),
+		MaxIdleConnsPerHost:   viper.GetInt("httpclient.maxidleconnsperhost"),
+		IdleConnTimeout:       viper.GetInt("httpclient.idleconntimeout"),
+		DNSCacheTTL:           viper.GetInt("httpclient.dns_cache_ttl"),
+		Resolver:              viper.GetString("httpclient.resolver"),
+		cookieJar:             jar,
 	}.GetClient()
 
 	var headers = make(map[string]string)
 	headers["Content-Type"] = "application/json"
+	headers["User-Agent"] = viper.GetString("httpclient.user_agent")
+	// Any additional headers configured for the fabric, like api keys for a gateway in front of the apic
+	for k, v := range fabricConfig.Headers {
+		headers[k] = v
+	}
 
 	urlMap := make(map[string]string)
 
 	urlMap["login"] = "/api/mo/aaaLogin.xml"
 	urlMap["logout"] = "/api/mo/aaaLogout.xml"
 	urlMap["faults"] = "/api/class/faultCountsWithDetails.json"
+	urlMap["fault_instances"] = "/api/class/faultInst.json"
 	urlMap["aci_name"] = "/api/mo/topology/pod-1/node-1/av.json"
 
 	return &AciConnection{
@@ -78,13 +111,41 @@ func newAciConnction(ctx context.Context, fabricConfig Fabric) *AciConnection {
 		Headers:          headers,
 		Client:           *httpClient,
 		responseTime:     responseTime,
+		maxResponseSize:  viper.GetInt64("httpclient.max_response_size"),
 	}
 }
 
+// loginError is returned by login when the apic rejected the username or password. A rejected login is not retried,
+// since it fail the same way on all apics and repeated failed logins may lock the user
+type loginError struct {
+	apic   string
+	status int
+}
+
+func (e loginError) Error() string {
+	return fmt.Sprintf("login to %s rejected with status %d, check the username and password", e.apic, e.status)
+}
+
+// isLoginError return true if the error is a rejected login, else the login failed since the apic could not be
+// reached or did not respond, and can be retried
+func isLoginError(err error) bool {
+	var loginErr loginError
+	return errors.As(err, &loginErr)
+}
+
 func (c AciConnection) login() error {
 	for i, controller := range c.fabricConfig.Apic {
 		_, status, err := c.doPostXML("login", fmt.Sprintf("%s%s", controller, c.URLMap["login"]),
-			[]byte(fmt.Sprintf("<aaaUser name=%s pwd=%s/>", c.fabricConfig.Username, c.fabricConfig.Password)))
+			[]byte(fmt.Sprintf("<aaaUser name=\"%s\" pwd=\"%s\"/>", html.EscapeString(c.fabricConfig.loginName()),
+				html.EscapeString(c.fabricConfig.Password))))
+		if status == http.StatusUnauthorized || status == http.StatusForbidden {
+			err = loginError{apic: controller, status: status}
+			log.WithFields(log.Fields{
+				"requestid": c.ctx.Value("requestid"),
+				"fabric":    fmt.Sprintf("%v", c.ctx.Value("fabric")),
+			}).Error(err)
+			return err
+		}
 		if err != nil || status != 200 {
 
 			err = fmt.Errorf("failed to login to %s, try next apic", controller)
@@ -95,6 +156,9 @@ func (c AciConnection) login() error {
 			}).Error(err)
 		} else {
 			*c.activeController = i
+			liveConnections.Lock()
+			liveConnections.connections[c.activeController] = c
+			liveConnections.Unlock()
 			log.WithFields(log.Fields{
 				"requestid": c.ctx.Value("requestid"),
 				"fabric":    fmt.Sprintf("%v", c.ctx.Value("fabric")),
@@ -107,8 +171,12 @@ func (c AciConnection) login() error {
 }
 
 func (c AciConnection) logout() bool {
+	liveConnections.Lock()
+	delete(liveConnections.connections, c.activeController)
+	liveConnections.Unlock()
+
 	_, status, err := c.doPostXML("logout", fmt.Sprintf("%s%s", c.fabricConfig.Apic[*c.activeController], c.URLMap["logout"]),
-		[]byte(fmt.Sprintf("<aaaUser name=%s/>", c.fabricConfig.Username)))
+		[]byte(fmt.Sprintf("<aaaUser name=\"%s\"/>", html.EscapeString(c.fabricConfig.loginName()))))
 	if err != nil || status != 200 {
 		log.WithFields(log.Fields{
 			"requestid": c.ctx.Value("requestid"),
@@ -119,6 +187,110 @@ func (c AciConnection) logout() bool {
 	return true
 }
 
+// logoutConnections logout all connections that are logged in, return false if not all logouts were done before the
+// context is done
+func logoutConnections(ctx context.Context) bool {
+	liveConnections.Lock()
+	var connections []AciConnection
+	for _, con := range liveConnections.connections {
+		connections = append(connections, con)
+	}
+	liveConnections.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		for _, con := range connections {
+			wg.Add(1)
+			go func(con AciConnection) {
+				defer wg.Done()
+				con.logout()
+			}(con)
+		}
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// retryBudget is the number of retries left for all queries of a scrape, so the retries of many failing queries do
+// not make the scrape take minutes
+type retryBudget struct {
+	remaining int32
+}
+
+func newRetryBudget(retries int) *retryBudget {
+	return &retryBudget{remaining: int32(retries)}
+}
+
+// take a retry from the budget, return false if the budget is used
+func (b *retryBudget) take() bool {
+	return atomic.AddInt32(&b.remaining, -1) >= 0
+}
+
+// scrapeResults hold the responses of the requests to the apic during a scrape by the url, so the same class that is
+// queried by several queries, like fabricNode, is only requested once per scrape
+type scrapeResults struct {
+	sync.Mutex
+	results map[string]*scrapeResult
+}
+
+// scrapeResult is the response of a request, done is closed when the response is received. The size is the number of
+// bytes read from the apic, also if the request failed
+type scrapeResult struct {
+	done chan struct{}
+	body []byte
+	size int
+	err  error
+}
+
+func newScrapeResults() *scrapeResults {
+	return &scrapeResults{results: make(map[string]*scrapeResult)}
+}
+
+// get the response of the url from the results, or with fetch if the url is not requested yet. A request that is
+// running is waited for. A failed request is not kept, so the next query do the request again
+func (r *scrapeResults) get(url string, fetch func() ([]byte, int, error)) ([]byte, int, error) {
+	r.Lock()
+	result, ok := r.results[url]
+	if !ok {
+		result = &scrapeResult{done: make(chan struct{})}
+		r.results[url] = result
+	}
+	r.Unlock()
+
+	if ok {
+		<-result.done
+		return result.body, result.size, result.err
+	}
+
+	result.body, result.size, result.err = fetch()
+	if result.err != nil {
+		r.Lock()
+		delete(r.results, url)
+		r.Unlock()
+	}
+	close(result.done)
+	return result.body, result.size, result.err
+}
+
+// refresh the login session, so the session do not time out
+func (c AciConnection) refresh() error {
+	_, err := c.get("aaaRefresh", fmt.Sprintf("%s/api/aaaRefresh.json", c.activeApic()))
+	return err
+}
+
+// activeApic return the url of the apic that the connection is logged in to
+func (c AciConnection) activeApic() string {
+	return c.fabricConfig.Apic[*c.activeController]
+}
+
 func (c AciConnection) getByQuery(table string) (string, error) {
 	data, err := c.get(table, fmt.Sprintf("%s%s", c.fabricConfig.Apic[*c.activeController], c.URLMap[table]))
 	if err != nil {
@@ -143,30 +315,102 @@ func (c AciConnection) getByClassQuery(class string, query string) (string, erro
 	return string(data), nil
 }
 
+// getByDnQuery query a single managed object, and optional its subtree, by its dn
+func (c AciConnection) getByDnQuery(dn string, query string) (string, error) {
+	data, err := c.get(dn, fmt.Sprintf("%s/api/mo/%s.json%s", c.fabricConfig.Apic[*c.activeController], dn, query))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": c.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", c.ctx.Value("fabric")),
+		}).Error(fmt.Sprintf("Dn request %s failed - %s.", dn, err))
+		return "", err
+	}
+	return string(data), nil
+}
+
+// getByNodeClassQuery query the objects of a class on a single node, where node is the dn of the node like
+// topology/pod-1/node-201
+func (c AciConnection) getByNodeClassQuery(node string, class string, query string) (string, error) {
+	data, err := c.get(class, fmt.Sprintf("%s/api/node/class/%s/%s.json%s", c.fabricConfig.Apic[*c.activeController], node, class, query))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": c.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", c.ctx.Value("fabric")),
+		}).Error(fmt.Sprintf("Node class request %s on %s failed - %s.", class, node, err))
+		return "", err
+	}
+	return string(data), nil
+}
+
+// get the url, from the results of the scrape if the url is already requested by another query of the scrape. The
+// duration and the size of the response are added to the query of the connection, also when the response is shared
+// with another query
 func (c AciConnection) get(label string, url string) ([]byte, error) {
 	start := time.Now()
-	body, status, err := c.doGet(url)
-	responseTime := time.Since(start).Seconds()
-	c.responseTime.With(prometheus.Labels{
-		"fabric": fmt.Sprintf("%v", c.ctx.Value("fabric")),
-		"class":  label,
-		"method": "GET",
-		"status": strconv.Itoa(status)}).Observe(responseTime)
+	var body []byte
+	var size int
+	var err error
+	if results, ok := c.ctx.Value("scraperesults").(*scrapeResults); ok {
+		body, size, err = results.get(url, func() ([]byte, int, error) {
+			return c.getWithRetry(label, url)
+		})
+	} else {
+		body, size, err = c.getWithRetry(label, url)
+	}
 
-	log.WithFields(log.Fields{
-		"method":    "GET",
-		"uri":       url,
-		"class":     label,
-		"status":    status,
-		"length":    len(body),
-		"requestid": c.ctx.Value("requestid"),
-		"exec_time": time.Since(start).Microseconds(),
-		"fabric":    fmt.Sprintf("%v", c.ctx.Value("fabric")),
-	}).Info("api call fabric")
+	if query, ok := c.ctx.Value("query").(string); ok {
+		requestDuration.WithLabelValues(fmt.Sprintf("%v", c.ctx.Value("fabric")), query).Observe(time.Since(start).Seconds())
+		if stats, ok := c.ctx.Value("querystats").(*queryStats); ok {
+			stats.addResponseBytes(query, size)
+		}
+	}
 	return body, err
 }
 
-func (c AciConnection) doGet(url string) ([]byte, int, error) {
+// getWithRetry get the url, and retry the request if the apic could not be reached or returned a server error. The
+// retries are taken from the retry budget of the scrape, if the budget is used the request is not retried. The size
+// is the number of bytes read from the apic by all the tries
+func (c AciConnection) getWithRetry(label string, url string) ([]byte, int, error) {
+	retries := viper.GetInt("httpclient.retries")
+	size := 0
+	for retry := 0; ; retry++ {
+		start := time.Now()
+		body, status, read, err := c.doGet(url)
+		size += read
+		c.responseTime.With(prometheus.Labels{
+			"fabric": fmt.Sprintf("%v", c.ctx.Value("fabric")),
+			"class":  label,
+			"method": "GET",
+			"status": strconv.Itoa(status)}).Observe(time.Since(start).Seconds())
+
+		log.WithFields(log.Fields{
+			"method":    "GET",
+			"uri":       url,
+			"class":     label,
+			"status":    status,
+			"length":    read,
+			"retry":     retry,
+			"requestid": c.ctx.Value("requestid"),
+			"exec_time": time.Since(start).Microseconds(),
+			"fabric":    fmt.Sprintf("%v", c.ctx.Value("fabric")),
+		}).Info("api call fabric")
+
+		if err == nil || retry >= retries || (status != 0 && status < http.StatusInternalServerError) || c.ctx.Err() != nil {
+			return body, size, err
+		}
+		if budget, ok := c.ctx.Value("retrybudget").(*retryBudget); ok && !budget.take() {
+			log.WithFields(log.Fields{
+				"requestid": c.ctx.Value("requestid"),
+				"fabric":    fmt.Sprintf("%v", c.ctx.Value("fabric")),
+			}).Warn(fmt.Sprintf("retry budget of the scrape is used, %s is not retried", label))
+			return body, size, err
+		}
+	}
+}
+
+// doGet get the url and return the body, the http status and the number of bytes of the body read, that is also
+// returned when the request failed, like for a response larger than the max response size
+func (c AciConnection) doGet(url string) ([]byte, int, int, error) {
 
 	req, err := http.NewRequest("GET", url, bytes.NewBuffer([]byte{}))
 	if err != nil {
@@ -174,11 +418,13 @@ func (c AciConnection) doGet(url string) ([]byte, int, error) {
 			"requestid": c.ctx.Value("requestid"),
 			"fabric":    fmt.Sprintf("%v", c.ctx.Value("fabric")),
 		}).Error(err)
-		return nil, 0, err
+		return nil, 0, 0, err
 	}
 	for k, v := range c.Headers {
 		req.Header.Set(k, v)
 	}
+	// Stop the request if the scrape timed out
+	req = req.WithContext(c.ctx)
 
 	resp, err := c.Client.Do(req)
 	if err != nil {
@@ -186,24 +432,34 @@ func (c AciConnection) doGet(url string) ([]byte, int, error) {
 			"requestid": c.ctx.Value("requestid"),
 			"fabric":    fmt.Sprintf("%v", c.ctx.Value("fabric")),
 		}).Error(err)
-		return nil, 0, err
+		return nil, 0, 0, err
 	}
 
 	defer resp.Body.Close()
 
 	if resp.StatusCode == http.StatusOK {
-		bodyBytes, err := ioutil.ReadAll(resp.Body)
+		var body io.Reader = resp.Body
+		if c.maxResponseSize > 0 {
+			// Read one byte more than the max to detect a response larger than the max
+			body = io.LimitReader(resp.Body, c.maxResponseSize+1)
+		}
+		bodyBytes, err := ioutil.ReadAll(body)
 		if err != nil {
 			log.WithFields(log.Fields{
 				"requestid": c.ctx.Value("requestid"),
 				"fabric":    fmt.Sprintf("%v", c.ctx.Value("fabric")),
 			}).Error(err)
-			return nil, resp.StatusCode, err
+			return nil, resp.StatusCode, len(bodyBytes), err
+		}
+		if c.maxResponseSize > 0 && int64(len(bodyBytes)) > c.maxResponseSize {
+			return nil, resp.StatusCode, len(bodyBytes), fmt.Errorf("ACI api response larger than max response size %d bytes", c.maxResponseSize)
 		}
 
-		return bodyBytes, resp.StatusCode, nil
+		return bodyBytes, resp.StatusCode, len(bodyBytes), nil
 	}
-	return nil, resp.StatusCode, fmt.Errorf("ACI api returned %d", resp.StatusCode)
+	// Read the body so the connection can be reused
+	read, _ := io.Copy(ioutil.Discard, resp.Body)
+	return nil, resp.StatusCode, int(read), fmt.Errorf("ACI api returned %d", resp.StatusCode)
 }
 
 func (c AciConnection) doPostXML(label string, url string, requestBody []byte) ([]byte, int, error) {
@@ -233,6 +489,9 @@ func (c AciConnection) doPostXML(label string, url string, requestBody []byte) (
 	}
 	responseTime := time.Since(start).Seconds()
 	var status = resp.StatusCode
+	if label == "login" {
+		saveCertificate(fmt.Sprintf("%v", c.ctx.Value("fabric")), req.URL.Host, resp.TLS)
+	}
 
 	c.responseTime.With(prometheus.Labels{
 		"fabric": fmt.Sprintf("%v", c.ctx.Value("fabric")),
@@ -263,5 +522,7 @@ func (c AciConnection) doPostXML(label string, url string, requestBody []byte) (
 
 		return bodyBytes, resp.StatusCode, nil
 	}
+	// Read the body so the connection can be reused
+	io.Copy(ioutil.Discard, resp.Body)
 	return nil, resp.StatusCode, fmt.Errorf("ACI api returned %d", resp.StatusCode)
 }
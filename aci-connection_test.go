@@ -0,0 +1,75 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+// Copyright 2020 Opsdis AB
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestQueryResponseBytes(t *testing.T) {
+	const fabricNodes = `{"totalCount":"1","imdata":[{"fabricNode":{"attributes":{"id":"101"}}}]}`
+	const errorBody = `{"imdata":[{"error":{"attributes":{"code":"400","text":"bad request"}}}]}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/class/fabricNode.json":
+			w.Write([]byte(fabricNodes))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(errorBody))
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name            string
+		class           string
+		queries         []string
+		maxResponseSize int
+		expected        int
+	}{
+		{name: "single query", class: "fabricNode", queries: []string{"nodes"}, expected: len(fabricNodes)},
+		{name: "shared response", class: "fabricNode", queries: []string{"nodes", "node_info", "node_health"}, expected: len(fabricNodes)},
+		{name: "failed request", class: "fvBD", queries: []string{"bridge_domains"}, expected: len(errorBody)},
+		{name: "larger than max response size", class: "fabricNode", queries: []string{"nodes"}, maxResponseSize: 10, expected: 11},
+	}
+
+	defer viper.Set("httpclient.max_response_size", viper.GetInt("httpclient.max_response_size"))
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			viper.Set("httpclient.max_response_size", test.maxResponseSize)
+			stats := newQueryStats()
+			ctx := context.WithValue(context.Background(), "fabric", "test")
+			ctx = context.WithValue(ctx, "scraperesults", newScrapeResults())
+			ctx = context.WithValue(ctx, "querystats", stats)
+			connection := *newAciConnction(ctx, Fabric{Apic: []string{server.URL}})
+
+			for _, query := range test.queries {
+				queryConnection := connection
+				queryConnection.ctx = context.WithValue(ctx, "query", query)
+				queryConnection.getByClassQuery(test.class, "")
+			}
+
+			for _, query := range test.queries {
+				if actual := stats.responseBytes[query]; actual != test.expected {
+					t.Errorf("%s: got %d bytes, expected %d", query, actual, test.expected)
+				}
+			}
+		})
+	}
+}
@@ -15,10 +15,16 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"net"
 	"os"
+	"os/signal"
+	"runtime"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -28,6 +34,7 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"net/http"
+	"net/url"
 )
 
 type loggingResponseWriter struct {
@@ -51,13 +58,17 @@ func (lrw *loggingResponseWriter) Write(b []byte) (int, error) {
 	return n, err
 }
 
-var version = "undefined"
+// version and commit of the build, set with -ldflags "-X main.version=<version> -X main.commit=<commit>"
+var (
+	version = "undefined"
+	commit  = "undefined"
+)
 
 func main() {
 
 	flag.Usage = func() {
 		fmt.Printf("Usage of %s:\n", ExporterName)
-		fmt.Printf("Version %s\n", version)
+		fmt.Printf("Version %s, commit %s\n", version, commit)
 		flag.PrintDefaults()
 	}
 
@@ -114,36 +125,101 @@ func main() {
 		os.Exit(1)
 	}
 
-	var classQueries = ClassQueries{}
-	err = viper.UnmarshalKey("class_queries", &classQueries)
+	allQueries, err := unmarshalQueries(viper.GetViper())
 	if err != nil {
-		log.Error("Unable to decode class_queries into struct - ", err)
+		log.Error("Configuration of queries not valid - ", err)
 		os.Exit(1)
 	}
 
-	var compoundClassQueries = CompoundClassQueries{}
-	err = viper.UnmarshalKey("compound_queries", &compoundClassQueries)
+	err = allQueries.addQueryFiles(viper.GetStringSlice("query_files"))
 	if err != nil {
-
-		log.Error("Unable to decode compound_queries into struct - ", err)
+		log.Error("Query files not valid - ", err)
 		os.Exit(1)
 	}
 
-	var groupClassQueries = GroupClassQueries{}
-	err = viper.UnmarshalKey("qroup_class_queries", &groupClassQueries)
+	err = allQueries.validate()
 	if err != nil {
+		log.Error("Configuration of queries not valid - ", err)
+		os.Exit(1)
+	}
 
-		log.Error("Unable to decode compound_queries into struct - ", err)
+	for fabric := range viper.GetStringMap("fabrics") {
+		fabricType := fabricConfiguration(fabric).Type
+		if fabricType != FabricTypeOnPrem && fabricType != FabricTypeCloud {
+			log.Error(fmt.Sprintf("Fabric %s has not a valid type %s, must be %s or %s", fabric, fabricType,
+				FabricTypeOnPrem, FabricTypeCloud))
+			os.Exit(1)
+		}
+	}
+
+	err = validateHTTPServerConfig()
+	if err != nil {
+		log.Error("Configuration of httpserver not valid - ", err)
 		os.Exit(1)
 	}
-	allQueries := AllQueries{
-		ClassQueries:         classQueries,
-		CompoundClassQueries: compoundClassQueries,
-		GroupClassQueries:    groupClassQueries,
+
+	err = validateFaultSeverities()
+	if err != nil {
+		log.Error("Configuration of builtin_queries.faults.severities not valid - ", err)
+		os.Exit(1)
 	}
 
 	handler := &HandlerInit{allQueries}
 
+	// Start fault subscriptions for the fabrics that have it enabled
+	for fabric := range viper.GetStringMap("fabrics") {
+		if viper.GetBool(fmt.Sprintf("fabrics.%s.fault_subscription", fabric)) {
+			subscription := newFaultSubscription(fabric, fabricConfiguration(fabric))
+			faultSubscriptions[fabric] = subscription
+			go subscription.run()
+		}
+	}
+
+	// Login to all fabrics in the background and keep the sessions for the scrapes
+	if viper.GetBool("session_cache.enabled") {
+		for fabric := range viper.GetStringMap("fabrics") {
+			session := newLoginSession(fabric, fabricConfiguration(fabric))
+			loginSessions[fabric] = session
+			go session.run()
+		}
+	}
+
+	// Collect the fabrics in the background, so the scrapes return the last collection without waiting for the apic
+	if viper.GetInt("background_collection.interval") > 0 {
+		fabrics := viper.GetStringSlice("background_collection.fabrics")
+		if len(fabrics) == 0 {
+			for fabric := range viper.GetStringMap("fabrics") {
+				fabrics = append(fabrics, fabric)
+			}
+		}
+		for _, fabric := range fabrics {
+			if !viper.IsSet(fmt.Sprintf("fabrics.%s", fabric)) {
+				log.Error(fmt.Sprintf("Fabric %s of the background collection is not configured", fabric))
+				os.Exit(1)
+			}
+			collector := newBackgroundCollector(fabric, allQueries)
+			backgroundCollectors[fabric] = collector
+			go collector.run()
+		}
+	}
+
+	// Push the metrics of all fabrics to a remote write endpoint
+	if viper.GetString("remote_write.url") != "" {
+		if viper.GetInt("remote_write.interval") <= 0 {
+			log.Error(fmt.Sprintf("The remote_write.interval %s must be at least 1 second", viper.GetString("remote_write.interval")))
+			os.Exit(1)
+		}
+		go newRemoteWriter(allQueries).run()
+	}
+
+	// The version of the exporter, always 1
+	promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: MetricsPrefix + "build_info",
+		Help: "A metric with a constant '1' value labeled by version, commit and goversion from which the exporter was built",
+	},
+		[]string{"version", "commit", "goversion"},
+	).WithLabelValues(version, commit, runtime.Version()).Set(1)
+
 	// Create a Prometheus histogram for response time of the exporter
 	responseTime := promauto.NewHistogramVec(prometheus.HistogramOpts{
 		Name:    MetricsPrefix + "request_duration_seconds",
@@ -155,39 +231,112 @@ func main() {
 
 	// Setup handler for aci destinations
 	http.Handle("/probe", logcall(promMonitor(http.HandlerFunc(handler.getMonitorMetrics), responseTime, "/probe")))
+	http.Handle("/query", logcall(promMonitor(http.HandlerFunc(handler.getQueryMetrics), responseTime, "/query")))
+	http.Handle("/json", logcall(promMonitor(http.HandlerFunc(handler.getJSONMetrics), responseTime, "/json")))
+	http.Handle("/validate", logcall(promMonitor(http.HandlerFunc(handler.getValidation), responseTime, "/validate")))
 	http.Handle("/alive", logcall(promMonitor(http.HandlerFunc(alive), responseTime, "/alive")))
 
+	// Return the metrics of the fabrics together with the exporter metrics, for a single exporter of several fabrics
+	errorHandling := promhttp.HTTPErrorOnError
+	if viper.GetBool("multi_fabric.enabled") {
+		for _, fabric := range viper.GetStringSlice("multi_fabric.fabrics") {
+			if !viper.IsSet(fmt.Sprintf("fabrics.%s", fabric)) {
+				log.Error(fmt.Sprintf("Fabric %s of the multi fabric collection is not configured", fabric))
+				os.Exit(1)
+			}
+		}
+		prometheus.MustRegister(newFabricsCollector(allQueries))
+		// A series of a fabric that is not consistent, like a duplicate series, should not fail the other fabrics
+		errorHandling = promhttp.ContinueOnError
+	}
+
 	// Setup handler for exporter metrics
-	http.Handle("/metrics", promhttp.HandlerFor(
+	http.Handle(viper.GetString("httpserver.metrics_path"), promhttp.HandlerFor(
 		prometheus.DefaultGatherer,
 		promhttp.HandlerOpts{
 			// Opt into OpenMetrics to support exemplars.
 			EnableOpenMetrics: true,
+			ErrorHandling:     errorHandling,
+			ErrorLog:          log.StandardLogger(),
 		},
 	))
 
-	log.Info(fmt.Sprintf("%s starting on port %d", ExporterName, viper.GetInt("port")))
+	listenAddress := net.JoinHostPort(viper.GetString("httpserver.address"), strconv.Itoa(viper.GetInt("port")))
+	log.Info(fmt.Sprintf("%s starting on %s", ExporterName, listenAddress))
 	log.Info(fmt.Sprintf("Read timeout %s, Write timeout %s", viper.GetDuration("httpserver.read_timeout")*time.Second, viper.GetDuration("httpserver.write_timeout")*time.Second))
 	s := &http.Server{
 		ReadTimeout:  viper.GetDuration("httpserver.read_timeout") * time.Second,
 		WriteTimeout: viper.GetDuration("httpserver.write_timeout") * time.Second,
-		Addr:         ":" + strconv.Itoa(viper.GetInt("port")),
+		Addr:         listenAddress,
 	}
-	log.Fatal(s.ListenAndServe())
+	go func() {
+		err := s.ListenAndServe()
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// Stop on SIGTERM, like from Kubernetes, or SIGINT
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	shutdown(s, <-stop)
 }
 
-type HandlerInit struct {
-	AllQueries AllQueries
+// shutdown stop the http server, waiting for running scrapes to finish, and logout all connections that are logged in
+// to the apic, so the exporter do not leave any sessions on the apic. The shutdown is bounded by
+// httpserver.shutdown_timeout in case the apic is not responding
+func shutdown(s *http.Server, sig os.Signal) {
+	timeout := viper.GetDuration("httpserver.shutdown_timeout") * time.Second
+	log.Info(fmt.Sprintf("%s received %s, shutdown within %s", ExporterName, sig, timeout))
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := s.Shutdown(ctx)
+	if err != nil {
+		log.Error(fmt.Sprintf("Shutdown of http server failed - %s", err))
+	}
+
+	if !logoutConnections(ctx) {
+		log.Warn("Shutdown timeout before all apic sessions were logged out")
+	}
+	log.Info(fmt.Sprintf("%s stopped", ExporterName))
 }
 
-func (h HandlerInit) getMonitorMetrics(w http.ResponseWriter, r *http.Request) {
+// validateHTTPServerConfig validate the listen address, metrics path and timeouts of the http server
+func validateHTTPServerConfig() error {
+	port := viper.GetInt("port")
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("port %d is not a valid port", port)
+	}
 
-	openmetrics := false
-	// Check accept header for open metrics
-	if r.Header.Get("Accept") == "application/openmetrics-text" || viper.GetBool("openmetrics") {
-		openmetrics = true
+	address := viper.GetString("httpserver.address")
+	if address != "" {
+		_, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(address, strconv.Itoa(port)))
+		if err != nil {
+			return fmt.Errorf("address %s is not valid - %s", address, err)
+		}
+	}
+
+	metricsPath := viper.GetString("httpserver.metrics_path")
+	if !strings.HasPrefix(metricsPath, "/") {
+		return fmt.Errorf("metrics path %s must start with /", metricsPath)
+	}
+	if metricsPath == "/probe" || metricsPath == "/query" || metricsPath == "/json" || metricsPath == "/validate" || metricsPath == "/alive" {
+		return fmt.Errorf("metrics path %s is used by the exporter", metricsPath)
 	}
 
+	if viper.GetInt("httpserver.read_timeout") < 0 || viper.GetInt("httpserver.write_timeout") < 0 {
+		return fmt.Errorf("read and write timeout must be 0 or larger")
+	}
+	return nil
+}
+
+type HandlerInit struct {
+	AllQueries AllQueries
+}
+
+func (h HandlerInit) getMonitorMetrics(w http.ResponseWriter, r *http.Request) {
 	fabric := r.URL.Query().Get("target")
 	queries := r.URL.Query().Get("queries")
 
@@ -201,45 +350,208 @@ func (h HandlerInit) getMonitorMetrics(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	username := viper.GetString(fmt.Sprintf("fabrics.%s.username", fabric))
-	password := viper.GetString(fmt.Sprintf("fabrics.%s.password", fabric))
-	apicControllers := viper.GetStringSlice(fmt.Sprintf("fabrics.%s.apic", fabric))
+	metrics, prefix, commonLabels := h.fabricMetrics(r, fabric, queries)
+	writeMetrics(w, r, metrics, prefix, commonLabels)
+}
 
-	fabricConfig := Fabric{Username: username, Password: password, Apic: apicControllers}
+// fabricMetrics return the last background collection of the fabric, if the fabric is collected in the background and
+// all queries are requested, else the fabric is collected by the request
+func (h HandlerInit) fabricMetrics(r *http.Request, fabric string, queries string) ([]MetricDefinition, string, map[string]string) {
+	if latest := collected(fabric); latest != nil && queries == "" {
+		return latest.metrics, latest.prefix, latest.commonLabels
+	}
+	metrics, prefix, commonLabels, _ := collectFabric(r.Context(), fabric, h.AllQueries, queries)
+	return metrics, prefix, commonLabels
+}
 
-	ctx := r.Context()
-	ctx = context.WithValue(ctx, "fabric", fabric)
-	api := *newAciAPI(ctx, fabricConfig, h.AllQueries, queries)
+// getQueryMetrics run a single configured or built-in query, named by the parameter name, and return its metrics. Used
+// to test a query without the load on the apic of a full scrape. The parameter target can be left out if only one
+// fabric is configured
+func (h HandlerInit) getQueryMetrics(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	fabric := targetFabric(r)
 
-	aciName, metrics, err := api.CollectMetrics()
+	if !viper.IsSet(fmt.Sprintf("fabrics.%s", fabric)) {
+		http.Error(w, fmt.Sprintf("fabric %s is not configured", fabric), http.StatusNotFound)
+		return
+	}
+	if !h.AllQueries.hasQuery(name) {
+		http.Error(w, fmt.Sprintf("query %s is not configured", name), http.StatusNotFound)
+		return
+	}
 
+	metrics, prefix, commonLabels, _ := collectFabric(r.Context(), fabric, h.AllQueries, name)
+	writeMetrics(w, r, metrics, prefix, commonLabels)
+}
+
+// targetFabric return the fabric of the parameter target, or the only fabric if target is not set and only one fabric
+// is configured
+func targetFabric(r *http.Request) string {
+	fabric := r.URL.Query().Get("target")
+	if fabric == "" {
+		if fabrics := viper.GetStringMap("fabrics"); len(fabrics) == 1 {
+			for k := range fabrics {
+				fabric = k
+			}
+		}
+	}
+	return fabric
+}
+
+// getValidation execute all queries of the fabric once and return, as json, the number of series of each metric by
+// query and if the query passed, so paths that do not match the response of the apic version are found
+func (h HandlerInit) getValidation(w http.ResponseWriter, r *http.Request) {
+	fabric := targetFabric(r)
+	if !viper.IsSet(fmt.Sprintf("fabrics.%s", fabric)) {
+		http.Error(w, fmt.Sprintf("fabric %s is not configured", fabric), http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := scrapeContext(r.Context(), fabric)
+	defer cancel()
+	api := *newAciAPI(ctx, fabricConfiguration(fabric), h.AllQueries, "")
+	result, err := api.ValidateQueries()
 	if err != nil {
-		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
-		w.Header().Set("Content-Length", "0")
+		http.Error(w, fmt.Sprintf("login to fabric %s failed - %s", fabric, err), http.StatusBadGateway)
+		return
+	}
 
-		lrw := loggingResponseWriter{ResponseWriter: w}
-		lrw.WriteHeader(503)
+	body, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, "validation can not be encoded as json", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Write(body)
+}
+
+// jsonMetrics is the response of the json endpoint, the metrics of a fabric with the labels common to all metrics
+type jsonMetrics struct {
+	Fabric  string             `json:"fabric"`
+	Prefix  string             `json:"prefix"`
+	Labels  map[string]string  `json:"labels"`
+	Metrics []MetricDefinition `json:"metrics"`
+}
+
+// getJSONMetrics return the metrics of the fabric as json, for systems that can not parse the Prometheus format. The
+// parameters are the same as for /probe
+func (h HandlerInit) getJSONMetrics(w http.ResponseWriter, r *http.Request) {
+	fabric := r.URL.Query().Get("target")
+	queries := r.URL.Query().Get("queries")
+
+	if !viper.IsSet(fmt.Sprintf("fabrics.%s", fabric)) {
+		http.Error(w, fmt.Sprintf("fabric %s is not configured", fabric), http.StatusNotFound)
+		return
+	}
+
+	metrics, prefix, commonLabels := h.fabricMetrics(r, fabric, queries)
+	body, err := json.Marshal(jsonMetrics{Fabric: fabric, Prefix: prefix, Labels: commonLabels, Metrics: metrics})
+	if err != nil {
+		// A value like NaN or Inf can not be json
+		log.Error(fmt.Sprintf("metrics of fabric %s can not be encoded as json - %s", fabric, err))
+		http.Error(w, "metrics can not be encoded as json", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Write(body)
+}
+
+// writeMetrics write the metrics in the Prometheus or OpenMetrics format
+func writeMetrics(w http.ResponseWriter, r *http.Request, metrics []MetricDefinition, prefix string, commonLabels map[string]string) {
+	openmetrics := false
+	// Check accept header for open metrics
+	if r.Header.Get("Accept") == "application/openmetrics-text" || viper.GetBool("openmetrics") {
+		openmetrics = true
+	}
+
+	var bodyText = Metrics2Prometheus(metrics, prefix, commonLabels, openmetrics)
+	if openmetrics {
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=0.0.1; charset=utf-8")
 	} else {
-		commonLabels := make(map[string]string)
-		commonLabels["aci"] = aciName
-		commonLabels["fabric"] = fabric
-
-		var bodyText = Metrics2Prometheus(metrics, api.metricPrefix, commonLabels, openmetrics)
-		if openmetrics {
-			w.Header().Set("Content-Type", "application/openmetrics-text; version=0.0.1; charset=utf-8")
-		} else {
-			w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
-		}
-		w.Header().Set("Content-Length", strconv.Itoa(len(bodyText)))
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(bodyText)))
 
-		lrw := loggingResponseWriter{ResponseWriter: w}
-		if bodyText == "" {
-			lrw.WriteHeader(404)
+	lrw := loggingResponseWriter{ResponseWriter: w}
+	if bodyText == "" {
+		lrw.WriteHeader(404)
+	}
+
+	w.Write([]byte(bodyText))
+}
+
+// collectFabric collect the metrics of the fabric and return them together with the metric prefix and the labels
+// common to all metrics. The error is the error of the login, where the metrics only include the exporter own metrics
+func collectFabric(ctx context.Context, fabric string, allQueries AllQueries, queries string) ([]MetricDefinition, string, map[string]string, error) {
+	ctx, cancel := scrapeContext(ctx, fabric)
+	defer cancel()
+	api := *newAciAPI(ctx, fabricConfiguration(fabric), allQueries, queries)
+
+	// If the login failed the metrics only include the exporter own metrics, like up
+	aciName, metrics, err := api.CollectMetrics()
+
+	commonLabels := make(map[string]string)
+	commonLabels["aci"] = aciName
+	commonLabels["fabric"] = fabric
+	if viper.GetBool("apic_label") && err == nil {
+		// The host name of the apic the metrics was collected from
+		apic, err := url.Parse(api.connection.activeApic())
+		if err == nil {
+			commonLabels["apic"] = apic.Hostname()
 		}
+	}
+	return metrics, api.metricPrefix, commonLabels, err
+}
 
-		w.Write([]byte(bodyText))
+// scrapeContext return the context of a scrape of the fabric, with the scrape timeout and the retry budget and
+// responses shared by the queries of the scrape
+func scrapeContext(ctx context.Context, fabric string) (context.Context, context.CancelFunc) {
+	ctx = context.WithValue(ctx, "fabric", fabric)
+	cancel := func() {}
+	if timeout := viper.GetDuration("scrape_timeout"); timeout > 0 {
+		// Queries not done before the deadline are not included in the scrape
+		ctx, cancel = context.WithTimeout(ctx, timeout*time.Second)
+	}
+	if budget := viper.GetInt("httpclient.retry_budget"); budget > 0 {
+		// The retries left of the scrape, shared by all queries
+		ctx = context.WithValue(ctx, "retrybudget", newRetryBudget(budget))
 	}
-	return
+	if viper.GetBool("scrape_cache") {
+		// The responses of the scrape, shared by all queries
+		ctx = context.WithValue(ctx, "scraperesults", newScrapeResults())
+	}
+	return ctx, cancel
+}
+
+// fabricConfiguration return the configuration of the named fabric. The username and password are taken from the
+// environment variables ACI_<FABRIC>_USERNAME and ACI_<FABRIC>_PASSWORD if set, before the configuration
+func fabricConfiguration(fabric string) Fabric {
+	username := viper.GetString(fmt.Sprintf("fabrics.%s.username", fabric))
+	if env, ok := fabricEnv(fabric, "username"); ok {
+		username = env
+	}
+	password := viper.GetString(fmt.Sprintf("fabrics.%s.password", fabric))
+	if env, ok := fabricEnv(fabric, "password"); ok {
+		password = env
+	}
+	apicControllers := viper.GetStringSlice(fmt.Sprintf("fabrics.%s.apic", fabric))
+	for i, apic := range apicControllers {
+		apicControllers[i] = apicURL(apic)
+	}
+	headers := viper.GetStringMapString(fmt.Sprintf("fabrics.%s.headers", fabric))
+	fabricType := strings.ToLower(viper.GetString(fmt.Sprintf("fabrics.%s.type", fabric)))
+	if fabricType == "" {
+		fabricType = FabricTypeOnPrem
+	}
+
+	loginDomain := viper.GetString(fmt.Sprintf("fabrics.%s.login_domain", fabric))
+	hardwareGeneration := viper.GetString(fmt.Sprintf("fabrics.%s.hardware_generation", fabric))
+
+	return Fabric{Username: username, Password: password, Apic: apicControllers, Headers: headers, Type: fabricType,
+		LoginDomain: loginDomain, HardwareGeneration: hardwareGeneration}
 }
 
 func alive(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,83 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+// Copyright 2020 Opsdis AB
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// apicCertificates hold the certificate presented by each apic at login by fabric name, kept between the scrapes so
+// the expiry is known also when a cached login session is used
+var apicCertificates = struct {
+	sync.Mutex
+	fabrics map[string]map[string]apicCertificate
+}{fabrics: make(map[string]map[string]apicCertificate)}
+
+type apicCertificate struct {
+	commonName string
+	notAfter   time.Time
+}
+
+// saveCertificate save the leaf certificate of the tls connection to the apic
+func saveCertificate(fabric string, apic string, state *tls.ConnectionState) {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return
+	}
+	cert := state.PeerCertificates[0]
+	apicCertificates.Lock()
+	defer apicCertificates.Unlock()
+	if _, ok := apicCertificates.fabrics[fabric]; !ok {
+		apicCertificates.fabrics[fabric] = make(map[string]apicCertificate)
+	}
+	apicCertificates.fabrics[fabric][apic] = apicCertificate{commonName: cert.Subject.CommonName, notAfter: cert.NotAfter}
+}
+
+// tlsCertExpiry return the seconds until the certificates of the apics expire, by the common name of the certificate.
+// An expired certificate has a negative value. If the apics share a certificate name the first to expire is returned
+func (p aciAPI) tlsCertExpiry() *MetricDefinition {
+	apicCertificates.Lock()
+	certificates := apicCertificates.fabrics[fmt.Sprintf("%v", p.ctx.Value("fabric"))]
+	expiry := make(map[string]time.Time)
+	for _, cert := range certificates {
+		if current, ok := expiry[cert.commonName]; !ok || cert.notAfter.Before(current) {
+			expiry[cert.commonName] = cert.notAfter
+		}
+	}
+	apicCertificates.Unlock()
+
+	if len(expiry) == 0 {
+		return nil
+	}
+
+	metricDefinition := MetricDefinition{}
+	metricDefinition.Name = "apic_tls_cert_expiry"
+	metricDefinition.Description = MetricDesc{
+		Help: "Returns the number of seconds until the tls certificate of the apic expire",
+		Type: "gauge",
+		Unit: "seconds",
+	}
+
+	for commonName, notAfter := range expiry {
+		metric := Metric{}
+		metric.Labels = make(map[string]string)
+		metric.Labels["cn"] = commonName
+		metric.Value = time.Until(notAfter).Seconds()
+		metricDefinition.Metrics = append(metricDefinition.Metrics, metric)
+	}
+
+	return &metricDefinition
+}
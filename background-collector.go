@@ -0,0 +1,106 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+// Copyright 2020 Opsdis AB
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var backgroundCollectionTimestamp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: MetricsPrefix + "background_collection_timestamp_seconds",
+	Help: "The unix time of the last successful background collection of the fabric",
+},
+	[]string{"fabric"},
+)
+
+// backgroundCollectors are the collectors of the fabrics collected in the background, by fabric name. Only set at
+// startup, so it is not guarded for concurrent access
+var backgroundCollectors = make(map[string]*backgroundCollector)
+
+// collectedMetrics is a complete collection of the metrics of a fabric
+type collectedMetrics struct {
+	metrics      []MetricDefinition
+	prefix       string
+	commonLabels map[string]string
+}
+
+// backgroundCollector collect the metrics of a fabric on an interval, so a scrape return the last complete collection
+// without waiting for the apic. The last collection is swapped atomically, so a scrape never wait for a running
+// collection
+type backgroundCollector struct {
+	fabric     string
+	interval   time.Duration
+	allQueries AllQueries
+	// The last collection, a *collectedMetrics
+	latest atomic.Value
+}
+
+func newBackgroundCollector(fabric string, allQueries AllQueries) *backgroundCollector {
+	return &backgroundCollector{
+		fabric:     fabric,
+		interval:   viper.GetDuration("background_collection.interval") * time.Second,
+		allQueries: allQueries,
+	}
+}
+
+// run collect the metrics of the fabric on every interval. A collection that take longer than the interval delay the
+// next collection, so there is never more than one collection of the fabric running
+func (c *backgroundCollector) run() {
+	log.WithFields(log.Fields{
+		"fabric":   c.fabric,
+		"interval": c.interval.String(),
+	}).Info("background collection started")
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		c.collect()
+		<-ticker.C
+	}
+}
+
+// collect the metrics of the fabric and replace the last collection. The metrics of a failed login are also kept,
+// since they report the fabric as down, but only a successful collection update the timestamp
+func (c *backgroundCollector) collect() {
+	ctx := context.WithValue(context.Background(), "requestid", nextRequestID())
+	metrics, prefix, commonLabels, err := collectFabric(ctx, c.fabric, c.allQueries, "")
+	c.latest.Store(&collectedMetrics{metrics: metrics, prefix: prefix, commonLabels: commonLabels})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": ctx.Value("requestid"),
+			"fabric":    c.fabric,
+		}).Error(fmt.Sprintf("background collection failed - %s", err))
+		return
+	}
+	backgroundCollectionTimestamp.WithLabelValues(c.fabric).Set(float64(time.Now().Unix()))
+}
+
+// collected return the last collection of the fabric, or nil if the fabric is not collected in the background or the
+// first collection is not done
+func collected(fabric string) *collectedMetrics {
+	collector, ok := backgroundCollectors[fabric]
+	if !ok {
+		return nil
+	}
+	latest, _ := collector.latest.Load().(*collectedMetrics)
+	return latest
+}
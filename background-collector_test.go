@@ -0,0 +1,77 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+// Copyright 2020 Opsdis AB
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestCollectedConcurrentReaders format the same background collection from concurrent scrapes, as /probe, /json and
+// the multi fabric collector do. Run with -race to detect writes to the shared metrics
+func TestCollectedConcurrentReaders(t *testing.T) {
+	collector := &backgroundCollector{fabric: "test"}
+	collector.latest.Store(&collectedMetrics{
+		metrics: []MetricDefinition{{
+			Name:        "node_health",
+			Description: MetricDesc{Help: "Returns the health of the node", Type: "gauge"},
+			Metrics: []Metric{
+				{Labels: map[string]string{"nodeid": "101"}, Value: 0.9},
+				{Labels: map[string]string{"nodeid": "102"}, Value: 1},
+			},
+		}},
+		prefix:       "aci_",
+		commonLabels: map[string]string{"aci": "fabric1", "fabric": "test"},
+	})
+	backgroundCollectors["test"] = collector
+	defer delete(backgroundCollectors, "test")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			latest := collected("test")
+			text := Metrics2Prometheus(latest.metrics, latest.prefix, latest.commonLabels, false)
+			if !strings.Contains(text, `aci_node_health{aci="fabric1",fabric="test",nodeid="101"} 0.9`) {
+				t.Errorf("unexpected exposition %s", text)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			latest := collected("test")
+			if _, err := json.Marshal(jsonMetrics{Fabric: "test", Prefix: latest.prefix, Labels: latest.commonLabels,
+				Metrics: latest.metrics}); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			latest := collected("test")
+			if metrics := constMetrics(latest.metrics, latest.prefix, latest.commonLabels); len(metrics) != 2 {
+				t.Errorf("got %d metrics, expected 2", len(metrics))
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The common labels are only added to the formatted series, not to the collected metrics
+	for _, metric := range collected("test").metrics[0].Metrics {
+		if _, ok := metric.Labels["fabric"]; ok {
+			t.Errorf("common labels added to the collected labels %v", metric.Labels)
+		}
+	}
+}
@@ -13,6 +13,19 @@
 
 package main
 
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// validMetricName is the allowed characters of a Prometheus metric name, also used for the unit that is part of the name
+var validMetricName = regexp.MustCompile("^[a-zA-Z_:][a-zA-Z0-9_:]*$")
+
 type ClassQueries map[string]*ClassQuery
 type CompoundClassQueries map[string]*CompoundClassQuery
 type GroupClassQueries map[string]*GroupClassQuery
@@ -26,6 +39,21 @@ type AllQueries struct {
 	GroupClassQueries    GroupClassQueries
 }
 
+// hasQuery return true if name is a configured or built-in query
+func (q AllQueries) hasQuery(name string) bool {
+	if _, ok := q.ClassQueries[name]; ok {
+		return true
+	}
+	if _, ok := q.CompoundClassQueries[name]; ok {
+		return true
+	}
+	if _, ok := q.GroupClassQueries[name]; ok {
+		return true
+	}
+	_, ok := builtInQueries[name]
+	return ok
+}
+
 type GroupClassQuery struct {
 	Name         string         `mapstructure:"name"`
 	Unit         string         `mapstructure:"unit"`
@@ -33,15 +61,163 @@ type GroupClassQuery struct {
 	Help         string         `mapstructure:"help"`
 	Queries      []ClassQuery   `string:"queries"`
 	StaticLabels []StaticLabels `string:"staticlabels"`
+	CacheTTL     int            `mapstructure:"cache_ttl"`
+	FabricTypes  []string       `mapstructure:"fabric_types"`
+	Enabled      *bool          `mapstructure:"enabled"`
 }
 
 // ClassQuery define the structure of configured queries
 type ClassQuery struct {
 	ClassName      string         `mapstructure:"class_name"`
+	Dn             string         `mapstructure:"dn"`
 	QueryParameter string         `mapstructure:"query_parameter"`
 	Metrics        []ConfigMetric `string:"metrics"`
 	Labels         []ConfigLabels `string:"labels"`
 	StaticLabels   []StaticLabels `string:"staticlabels"`
+	// The time in seconds the result of the query is cached, 0 is no caching
+	CacheTTL int `mapstructure:"cache_ttl"`
+	// The fabric types, onprem or cloud, the query is executed on, default onprem
+	FabricTypes []string `mapstructure:"fabric_types"`
+	// Add the dn of the object as the label dn, default false since every object get its own series
+	DnLabel bool `mapstructure:"dn_label"`
+	// Add the label status, healthy, degraded or critical, from the health score of the value
+	HealthStatus bool `mapstructure:"health_status"`
+	// The time window of a stats class, like 15min or 1h, replace the window of the class name
+	StatsWindow string `mapstructure:"stats_window"`
+	// Only the number of objects of the class is returned by the apic, with rsp-subtree-include=count
+	CountOnly bool `mapstructure:"count_only"`
+	// The number of objects requested per request, the query is done in pages that are merged, 0 is no paging
+	PageSize int `mapstructure:"page_size"`
+	// Only every sample:th series of each metric is returned, 0 or 1 is all series
+	Sample int `mapstructure:"sample"`
+	// The max number of series of each metric of the query, the rest are dropped, 0 is no limit
+	MaxSeries int `mapstructure:"max_series"`
+	// If the query is executed, default true. In a group query it enable or disable the query of the group
+	Enabled *bool `mapstructure:"enabled"`
+	// The syntax of the value_name and property_name paths, gjson, default, or jsonpath
+	PathSyntax string `mapstructure:"path_syntax"`
+}
+
+// isEnabled return true if a query is enabled, the enabled flag is true or not set
+func isEnabled(enabled *bool) bool {
+	return enabled == nil || *enabled
+}
+
+// statsWindows are the time windows of the stats classes, the suffix of the class name like procSysCPU5min
+var statsWindows = []string{"5min", "15min", "1h", "1d", "1w", "1mo", "1qtr", "1year"}
+
+// setStatsWindow change the class of the query to the class of the stats window, like procSysCPU5min to procSysCPU1h.
+// The class name is also changed in the query parameter and the paths and regex of the metrics and labels
+func (q *ClassQuery) setStatsWindow() error {
+	if q.StatsWindow == "" {
+		return nil
+	}
+	if !contains(statsWindows, q.StatsWindow) {
+		return fmt.Errorf("stats window %s not valid, must be one of %s", q.StatsWindow, strings.Join(statsWindows, ", "))
+	}
+	current := ""
+	for _, window := range statsWindows {
+		// The longest match, 15min also end with 5min
+		if strings.HasSuffix(q.ClassName, window) && len(window) > len(current) {
+			current = window
+		}
+	}
+	if current == "" {
+		return fmt.Errorf("class %s is not a stats class with a time window", q.ClassName)
+	}
+
+	class := q.ClassName
+	windowClass := strings.TrimSuffix(class, current) + q.StatsWindow
+	q.ClassName = windowClass
+	q.QueryParameter = strings.ReplaceAll(q.QueryParameter, class, windowClass)
+	for i := range q.Metrics {
+		q.Metrics[i].ValueName = strings.ReplaceAll(q.Metrics[i].ValueName, class, windowClass)
+		q.Metrics[i].ValueCalculation = strings.ReplaceAll(q.Metrics[i].ValueCalculation, class, windowClass)
+	}
+	for i := range q.Labels {
+		q.Labels[i].PropertyName = strings.ReplaceAll(q.Labels[i].PropertyName, class, windowClass)
+		q.Labels[i].Regex = strings.ReplaceAll(q.Labels[i].Regex, class, windowClass)
+	}
+	return nil
+}
+
+// translatePaths translate the paths to gjson paths if the path syntax is jsonpath. An empty path is not changed
+func translatePaths(pathSyntax string, paths ...*string) error {
+	switch pathSyntax {
+	case "", PathSyntaxGjson:
+		return nil
+	case PathSyntaxJSONPath:
+	default:
+		return fmt.Errorf("path syntax %s not valid, must be %s or %s", pathSyntax, PathSyntaxGjson, PathSyntaxJSONPath)
+	}
+	for _, path := range paths {
+		if *path == "" {
+			continue
+		}
+		translated, err := jsonPathToGjson(*path)
+		if err != nil {
+			return err
+		}
+		*path = translated
+	}
+	return nil
+}
+
+// setPathSyntax translate the value and label paths of the query to gjson paths if they are jsonpath expressions
+func (q *ClassQuery) setPathSyntax() error {
+	var paths []*string
+	for i := range q.Metrics {
+		paths = append(paths, &q.Metrics[i].ValueName)
+	}
+	for i := range q.Labels {
+		paths = append(paths, &q.Labels[i].PropertyName)
+	}
+	return translatePaths(q.PathSyntax, paths...)
+}
+
+// setPathSyntax translate the value paths of the compound query to gjson paths if they are jsonpath expressions
+func (q *CompoundClassQuery) setPathSyntax() error {
+	var paths []*string
+	for i := range q.Metrics {
+		paths = append(paths, &q.Metrics[i].ValueName)
+	}
+	for i := range q.ClassNames {
+		paths = append(paths, &q.ClassNames[i].ValueName)
+	}
+	return translatePaths(q.PathSyntax, paths...)
+}
+
+// countValueName is the path of the count in the response of a query with rsp-subtree-include=count
+const countValueName = "moCount.attributes.count"
+
+// setCountOnly add rsp-subtree-include=count to the query parameter of a count only query, so the apic return a
+// single moCount object instead of all objects of the class. A metric without value_name get the count as value
+func (q *ClassQuery) setCountOnly() error {
+	if !q.CountOnly {
+		return nil
+	}
+	if strings.Contains(q.QueryParameter, "rsp-subtree-include") {
+		return fmt.Errorf("count_only can not be used with rsp-subtree-include in the query parameter")
+	}
+	q.QueryParameter = addQueryParameter(q.QueryParameter, "rsp-subtree-include=count")
+	for i := range q.Metrics {
+		if q.Metrics[i].ValueName == "" {
+			q.Metrics[i].ValueName = countValueName
+		}
+	}
+	return nil
+}
+
+// addQueryParameter add the parameter, like page-size=100, to the query parameters of a query
+func addQueryParameter(query string, parameter string) string {
+	switch {
+	case query == "":
+		return "?" + parameter
+	case strings.HasPrefix(query, "?"):
+		return query + "&" + parameter
+	default:
+		return "?" + query + "&" + parameter
+	}
 }
 
 // ConfigMetric define the configuration of metric
@@ -68,9 +244,13 @@ type StaticLabels struct {
 
 // CompoundClassQuery define aggregation by common label, typical used for counting
 type CompoundClassQuery struct {
-	ClassNames []ClassLabelMapping `string:"classnames"`
-	Metrics    []ConfigMetric      `string:"metrics"`
-	LabelName  string              `mapstructure:"labelname"`
+	ClassNames  []ClassLabelMapping `string:"classnames"`
+	Metrics     []ConfigMetric      `string:"metrics"`
+	LabelName   string              `mapstructure:"labelname"`
+	CacheTTL    int                 `mapstructure:"cache_ttl"`
+	FabricTypes []string            `mapstructure:"fabric_types"`
+	Enabled     *bool               `mapstructure:"enabled"`
+	PathSyntax  string              `mapstructure:"path_syntax"`
 }
 
 type ClassLabelMapping struct {
@@ -79,3 +259,149 @@ type ClassLabelMapping struct {
 	QueryParameter string `mapstructure:"query_parameter"`
 	ValueName      string `mapstructure:"value_name"`
 }
+
+// unmarshalQueries return the class, compound and group queries of a configuration
+func unmarshalQueries(v *viper.Viper) (AllQueries, error) {
+	var classQueries = ClassQueries{}
+	err := v.UnmarshalKey("class_queries", &classQueries)
+	if err != nil {
+		return AllQueries{}, fmt.Errorf("unable to decode class_queries into struct - %s", err)
+	}
+
+	var compoundClassQueries = CompoundClassQueries{}
+	err = v.UnmarshalKey("compound_queries", &compoundClassQueries)
+	if err != nil {
+		return AllQueries{}, fmt.Errorf("unable to decode compound_queries into struct - %s", err)
+	}
+
+	var groupClassQueries = GroupClassQueries{}
+	err = v.UnmarshalKey("qroup_class_queries", &groupClassQueries)
+	if err != nil {
+		return AllQueries{}, fmt.Errorf("unable to decode qroup_class_queries into struct - %s", err)
+	}
+
+	return AllQueries{
+		ClassQueries:         classQueries,
+		CompoundClassQueries: compoundClassQueries,
+		GroupClassQueries:    groupClassQueries,
+	}, nil
+}
+
+// addQueryFiles add the queries of the query files matching the file patterns. A query file has the same
+// class_queries, compound_queries and qroup_class_queries sections as the configuration file, so a set of queries can
+// be shared as a file. A query name must be unique over the configuration and all query files
+func (q AllQueries) addQueryFiles(patterns []string) error {
+	for _, pattern := range patterns {
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("query file pattern %s not valid - %s", pattern, err)
+		}
+		sort.Strings(files)
+		for _, file := range files {
+			v := viper.New()
+			v.SetConfigFile(file)
+			v.SetConfigType("yaml")
+			err = v.ReadInConfig()
+			if err != nil {
+				return fmt.Errorf("query file %s not valid - %s", file, err)
+			}
+			fileQueries, err := unmarshalQueries(v)
+			if err != nil {
+				return fmt.Errorf("query file %s not valid - %s", file, err)
+			}
+
+			for name, query := range fileQueries.ClassQueries {
+				if q.hasQuery(name) {
+					return fmt.Errorf("query %s in query file %s is already defined", name, file)
+				}
+				q.ClassQueries[name] = query
+			}
+			for name, query := range fileQueries.CompoundClassQueries {
+				if q.hasQuery(name) {
+					return fmt.Errorf("query %s in query file %s is already defined", name, file)
+				}
+				q.CompoundClassQueries[name] = query
+			}
+			for name, query := range fileQueries.GroupClassQueries {
+				if q.hasQuery(name) {
+					return fmt.Errorf("query %s in query file %s is already defined", name, file)
+				}
+				q.GroupClassQueries[name] = query
+			}
+		}
+	}
+	return nil
+}
+
+// validate the metric name, type and unit of all queries, so the HELP and TYPE lines of the metrics are valid. A
+// metric without type is a gauge, and a metric without help get its name as help. The class of the queries with a
+// stats window is set to the class of the window, and the count is requested for count only queries
+func (q AllQueries) validate() error {
+	for name, query := range q.ClassQueries {
+		if err := query.setPathSyntax(); err != nil {
+			return fmt.Errorf("query %s - %s", name, err)
+		}
+		if err := query.setStatsWindow(); err != nil {
+			return fmt.Errorf("query %s - %s", name, err)
+		}
+		if err := query.setCountOnly(); err != nil {
+			return fmt.Errorf("query %s - %s", name, err)
+		}
+		for i := range query.Metrics {
+			if err := validateMetric(&query.Metrics[i].Name, &query.Metrics[i].Type, query.Metrics[i].Unit, &query.Metrics[i].Help); err != nil {
+				return fmt.Errorf("query %s - %s", name, err)
+			}
+		}
+	}
+	for name, query := range q.CompoundClassQueries {
+		if len(query.Metrics) == 0 {
+			return fmt.Errorf("query %s - no metric", name)
+		}
+		if err := query.setPathSyntax(); err != nil {
+			return fmt.Errorf("query %s - %s", name, err)
+		}
+		for i := range query.Metrics {
+			if err := validateMetric(&query.Metrics[i].Name, &query.Metrics[i].Type, query.Metrics[i].Unit, &query.Metrics[i].Help); err != nil {
+				return fmt.Errorf("query %s - %s", name, err)
+			}
+		}
+	}
+	for name, query := range q.GroupClassQueries {
+		for i := range query.Queries {
+			if err := query.Queries[i].setPathSyntax(); err != nil {
+				return fmt.Errorf("query %s - %s", name, err)
+			}
+			if err := query.Queries[i].setStatsWindow(); err != nil {
+				return fmt.Errorf("query %s - %s", name, err)
+			}
+			if err := query.Queries[i].setCountOnly(); err != nil {
+				return fmt.Errorf("query %s - %s", name, err)
+			}
+		}
+		if err := validateMetric(&query.Name, &query.Type, query.Unit, &query.Help); err != nil {
+			return fmt.Errorf("query %s - %s", name, err)
+		}
+	}
+	return nil
+}
+
+func validateMetric(name *string, metricType *string, unit string, help *string) error {
+	if !validMetricName.MatchString(*name) {
+		return fmt.Errorf("metric name %s not valid", *name)
+	}
+	if unit != "" && !validMetricName.MatchString(unit) {
+		return fmt.Errorf("unit %s of metric %s not valid", unit, *name)
+	}
+	switch strings.ToLower(*metricType) {
+	case "":
+		*metricType = "gauge"
+	case "gauge", "counter":
+		*metricType = strings.ToLower(*metricType)
+	default:
+		return fmt.Errorf("type %s of metric %s not valid, must be gauge or counter", *metricType, *name)
+	}
+	if *help == "" {
+		*help = *name
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+// Copyright 2020 Opsdis AB
+
+package main
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// exampleQueries return the validated queries of the example configuration
+func exampleQueries(t *testing.T) AllQueries {
+	t.Helper()
+	v := viper.New()
+	v.SetConfigFile("example-config.yaml")
+	if err := v.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+	queries, err := unmarshalQueries(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := queries.validate(); err != nil {
+		t.Fatal(err)
+	}
+	return queries
+}
+
+func TestExampleInterfaceCrcErrors(t *testing.T) {
+	query := exampleQueries(t).ClassQueries["interface_rx_crc_err_stats"]
+	if query == nil {
+		t.Fatal("interface_rx_crc_err_stats not in the example configuration")
+	}
+	stats := func(dn string, crcCum string) string {
+		return `{"eqptIngrErrPkts5min":{"attributes":{"dn":"` + dn + `","crcCum":"` + crcCum + `","crcLast":"1"}}}`
+	}
+	responses := map[string]string{
+		"/api/class/eqptIngrErrPkts5min.json": `{"totalCount":"2","imdata":[` +
+			stats("topology/pod-1/node-101/sys/phys-[eth1/1]/CDeqptIngrErrPkts5min", "12") + `,` +
+			stats("topology/pod-1/node-102/sys/phys-[eth1/49]/CDeqptIngrErrPkts5min", "0") + `]}`,
+	}
+
+	metrics := runQuery(newFixtureAPI(responses), func(api aciAPI, ch chan []MetricDefinition) {
+		api.getClassMetrics(ch, "interface_rx_crc_err_stats", query)
+	})
+	if metrics == nil {
+		t.Fatal("interface_rx_crc_err_stats failed")
+	}
+	assertSeries(t, metrics, "interface_crc_errors", map[string]float64{
+		"interface=eth1/1,interface_type=phys,nodeid=101,podid=1":  12,
+		"interface=eth1/49,interface_type=phys,nodeid=102,podid=1": 0,
+	})
+	for _, metricDefinition := range metrics {
+		if metricDefinition.Name == "interface_crc_errors" && metricDefinition.Description.Type != "counter" {
+			t.Errorf("interface_crc_errors: got type %s, expected counter", metricDefinition.Description.Type)
+		}
+	}
+}
@@ -14,6 +14,7 @@
 package main
 
 import (
+	"fmt"
 	"strings"
 
 	"github.com/spf13/viper"
@@ -54,10 +55,98 @@ func SetDefaultValues() {
 	viper.SetDefault("prefix", "aci_")
 	viper.BindEnv("prefix")
 
+	// If set to true the host name of the apic is added as the label apic to all metrics
+	viper.SetDefault("apic_label", false)
+	viper.BindEnv("apic_label")
+
+	// If set to true the apic controllers are included in the built-in queries that report by node, node_time_drift,
+	// node_faults, node_registration and equipment_redundancy
+	viper.SetDefault("include_controllers", false)
+	viper.BindEnv("include_controllers")
+
+	// If set to false the metrics of the scrape itself, like scrape_duration_seconds and query_success, are not
+	// returned, up is always returned
+	viper.SetDefault("scrape_metrics", true)
+	viper.BindEnv("scrape_metrics")
+
+	// The number of decimals metric values are rounded to, -1 is no rounding
+	viper.SetDefault("precision", -1)
+	viper.BindEnv("precision")
+
+	// The max length of a label value, longer values are truncated and end with ... and a hash, 0 is no limit
+	viper.SetDefault("label_max_length", 0)
+	viper.BindEnv("label_max_length")
+
+	// The max time in seconds of a scrape, queries not done in time are not included, 0 is no timeout
+	viper.SetDefault("scrape_timeout", 0)
+	viper.BindEnv("scrape_timeout")
+
+	// Request a url only once per scrape, the queries of the scrape with the same request share the response
+	viper.SetDefault("scrape_cache", true)
+	viper.BindEnv("scrape_cache")
+
+	// The lowest health score that is healthy and degraded for the status label of queries with health_status
+	viper.SetDefault("health_thresholds.healthy", 90)
+	viper.BindEnv("health_thresholds.healthy")
+	viper.SetDefault("health_thresholds.degraded", 70)
+	viper.BindEnv("health_thresholds.degraded")
+
 	// If set to true response will always be in openmetrics format
 	viper.SetDefault("openmetrics", false)
 	viper.BindEnv("openmetrics")
 
+	// Built-in queries
+	// All built-in queries are executed if not disabled
+	for name := range builtInQueries {
+		viper.SetDefault(fmt.Sprintf("builtin_queries.%s.enabled", name), true)
+		viper.BindEnv(fmt.Sprintf("builtin_queries.%s.enabled", name))
+	}
+
+	// All registered metric processors are executed if not disabled
+	for _, processor := range metricProcessors {
+		viper.SetDefault(fmt.Sprintf("metric_processors.%s.enabled", processor.Name()), true)
+		viper.BindEnv(fmt.Sprintf("metric_processors.%s.enabled", processor.Name()))
+	}
+
+	// The metric and class label of the node health used for the pod health
+	viper.SetDefault("metric_processors.pod_health.metric", "health")
+	viper.BindEnv("metric_processors.pod_health.metric")
+	viper.SetDefault("metric_processors.pod_health.class", "topSystem")
+	viper.BindEnv("metric_processors.pod_health.class")
+
+	// The severities of the faults and faults_acked metrics, crit, maj, minor and warn
+	viper.SetDefault("builtin_queries.faults.severities", []string{"crit", "maj", "minor", "warn"})
+	viper.BindEnv("builtin_queries.faults.severities")
+
+	// The number of operational power supplies a node must have to be redundant
+	viper.SetDefault("builtin_queries.equipment_redundancy.psu_required", 2)
+	viper.BindEnv("builtin_queries.equipment_redundancy.psu_required")
+
+	// The number of operational fan trays a node must have to be redundant, 0 is all fan trays of the node
+	viper.SetDefault("builtin_queries.equipment_redundancy.fan_required", 0)
+	viper.BindEnv("builtin_queries.equipment_redundancy.fan_required")
+
+	// The mtu of an interface configured to inherit the mtu, the default mtu of the fabric
+	viper.SetDefault("builtin_queries.interface_mtu.inherit_mtu", 9000)
+	viper.BindEnv("builtin_queries.interface_mtu.inherit_mtu")
+
+	// The drop counters of the interfaces included in the fabric drops, by the name of the counter without Rate
+	viper.SetDefault("builtin_queries.fabric_drops.ingress_counters", []string{"buffer", "error", "forwarding"})
+	viper.BindEnv("builtin_queries.fabric_drops.ingress_counters")
+	viper.SetDefault("builtin_queries.fabric_drops.egress_counters", []string{"buffer", "error", "afdWred"})
+	viper.BindEnv("builtin_queries.fabric_drops.egress_counters")
+
+	// The time in seconds a login session without any activity is active, the apic default web token timeout
+	viper.SetDefault("builtin_queries.active_sessions.session_timeout", 600)
+	viper.BindEnv("builtin_queries.active_sessions.session_timeout")
+
+	// The max number of series of a metric before a warning is logged, 0 is no limit. If drop is set the metric is
+	// not returned
+	viper.SetDefault("cardinality.max_series", 0)
+	viper.BindEnv("cardinality.max_series")
+	viper.SetDefault("cardinality.drop", false)
+	viper.BindEnv("cardinality.drop")
+
 	// HTTPCLient
 	viper.SetDefault("HTTPClient.timeout", 0)
 	viper.BindEnv("HTTPClient.timeout")
@@ -65,18 +154,111 @@ func SetDefaultValues() {
 	viper.SetDefault("HTTPClient.keepalive", 15)
 	viper.BindEnv("HTTPClient.keepalive")
 
-	// This is currently not used
+	// Seconds to wait for the tls handshake with the apic, 0 is no timeout
 	viper.SetDefault("HTTPClient.tlshandshaketimeout", 10)
 	viper.BindEnv("HTTPClient.tlshandshaketimeout")
 
+	// Seconds to wait for the response headers of the apic after the request is sent, 0 is no timeout
+	viper.SetDefault("HTTPClient.response_header_timeout", 0)
+	viper.BindEnv("HTTPClient.response_header_timeout")
+
 	viper.SetDefault("HTTPClient.insecureHTTPS", true)
 	viper.BindEnv("HTTPClient.insecureHTTPS")
 
+	// The max size in bytes of a response from the apic, 0 is no limit
+	viper.SetDefault("HTTPClient.max_response_size", 0)
+	viper.BindEnv("HTTPClient.max_response_size")
+
+	// The number of times a query is retried if the apic could not be reached or returned a server error
+	viper.SetDefault("HTTPClient.retries", 0)
+	viper.BindEnv("HTTPClient.retries")
+
+	// The max number of retries of all queries of a scrape, 0 is no limit
+	viper.SetDefault("HTTPClient.retry_budget", 10)
+	viper.BindEnv("HTTPClient.retry_budget")
+
+	// The User-Agent header of all requests to the apic, identify the exporter in the apic audit log
+	viper.SetDefault("HTTPClient.user_agent", ExporterName+"/"+version)
+	viper.BindEnv("HTTPClient.user_agent")
+
+	// The seconds the resolved addresses of the apic are cached, 0 is no caching
+	viper.SetDefault("HTTPClient.dns_cache_ttl", 0)
+	viper.BindEnv("HTTPClient.dns_cache_ttl")
+
+	// The address of the DNS server used to resolve the apic, default the resolver of the system
+	viper.SetDefault("HTTPClient.resolver", "")
+	viper.BindEnv("HTTPClient.resolver")
+
+	// Connection pool, idle connections to the apic are reused between scrapes
+	viper.SetDefault("HTTPClient.maxidleconns", 100)
+	viper.BindEnv("HTTPClient.maxidleconns")
+
+	viper.SetDefault("HTTPClient.maxidleconnsperhost", 10)
+	viper.BindEnv("HTTPClient.maxidleconnsperhost")
+
+	viper.SetDefault("HTTPClient.idleconntimeout", 90)
+	viper.BindEnv("HTTPClient.idleconntimeout")
+
+	// Fault subscription
+	viper.SetDefault("fault_subscription.refresh_timeout", 60)
+	viper.BindEnv("fault_subscription.refresh_timeout")
+
+	viper.SetDefault("fault_subscription.session_refresh", 300)
+	viper.BindEnv("fault_subscription.session_refresh")
+
+	viper.SetDefault("fault_subscription.retry_interval", 30)
+	viper.BindEnv("fault_subscription.retry_interval")
+
+	// Session cache, login to the fabrics at startup and keep the sessions for the scrapes
+	viper.SetDefault("session_cache.enabled", false)
+	viper.BindEnv("session_cache.enabled")
+
+	viper.SetDefault("session_cache.refresh_interval", 300)
+	viper.BindEnv("session_cache.refresh_interval")
+
+	viper.SetDefault("session_cache.retry_interval", 30)
+	viper.BindEnv("session_cache.retry_interval")
+
+	// Return the metrics of the fabrics in multi_fabric.fabrics, default all, on the path of the exporter metrics
+	viper.SetDefault("multi_fabric.enabled", false)
+	viper.BindEnv("multi_fabric.enabled")
+
+	// The seconds between the background collections of the fabrics, 0 is no background collection
+	viper.SetDefault("background_collection.interval", 0)
+	viper.BindEnv("background_collection.interval")
+
+	// Remote write, push the metrics of the fabrics to the url, disabled if no url is set
+	viper.SetDefault("remote_write.url", "")
+	viper.BindEnv("remote_write.url")
+
+	viper.SetDefault("remote_write.interval", 60)
+	viper.BindEnv("remote_write.interval")
+
+	viper.SetDefault("remote_write.timeout", 10)
+	viper.BindEnv("remote_write.timeout")
+
+	viper.SetDefault("remote_write.username", "")
+	viper.BindEnv("remote_write.username")
+
+	viper.SetDefault("remote_write.password", "")
+	viper.BindEnv("remote_write.password")
+
 	// HTTPServer
+	// The address to listen on, default all interfaces
+	viper.SetDefault("httpserver.address", "")
+	viper.BindEnv("httpserver.address")
+
+	viper.SetDefault("httpserver.metrics_path", "/metrics")
+	viper.BindEnv("httpserver.metrics_path")
+
 	viper.SetDefault("httpserver.read_timeout", 0)
 	viper.BindEnv("httpserver.read_timeout")
 
 	viper.SetDefault("httpserver.write_timeout", 0)
 	viper.BindEnv("httpserver.write_timeout")
 
+	// The max time in seconds to wait for running scrapes and the logout of the apic sessions on shutdown
+	viper.SetDefault("httpserver.shutdown_timeout", 10)
+	viper.BindEnv("httpserver.shutdown_timeout")
+
 }
@@ -0,0 +1,109 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+// Copyright 2020 Opsdis AB
+
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// dnsCache keep the resolved addresses of the apic host names for the ttl, so a slow or flaky DNS does not add
+// latency or failures to every new connection to the apic
+type dnsCache struct {
+	resolver *net.Resolver
+	ttl      time.Duration
+	mutex    sync.Mutex
+	entries  map[string]dnsEntry
+}
+
+type dnsEntry struct {
+	addresses []string
+	expires   time.Time
+}
+
+func newDNSCache(resolver *net.Resolver, ttl time.Duration) *dnsCache {
+	return &dnsCache{
+		resolver: resolver,
+		ttl:      ttl,
+		entries:  make(map[string]dnsEntry),
+	}
+}
+
+// lookup return the addresses of the host, from the cache if not expired. If the lookup fail the expired addresses
+// are used, since the apic addresses seldom change
+func (d *dnsCache) lookup(ctx context.Context, host string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+
+	d.mutex.Lock()
+	entry, ok := d.entries[host]
+	d.mutex.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.addresses, nil
+	}
+
+	addresses, err := d.resolver.LookupHost(ctx, host)
+	if err != nil {
+		if ok {
+			return entry.addresses, nil
+		}
+		return nil, err
+	}
+
+	d.mutex.Lock()
+	d.entries[host] = dnsEntry{addresses: addresses, expires: time.Now().Add(d.ttl)}
+	d.mutex.Unlock()
+	return addresses, nil
+}
+
+// dialContext return a dial function that connect to the cached addresses of the host, trying each address until a
+// connection is made
+func (d *dnsCache) dialContext(dialer *net.Dialer) func(ctx context.Context, network string, address string) (net.Conn, error) {
+	return func(ctx context.Context, network string, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		addresses, err := d.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		var conn net.Conn
+		for _, addr := range addresses {
+			conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(addr, port))
+			if err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+}
+
+// newResolver return a resolver that use the DNS server address, like 10.0.0.53 or 10.0.0.53:53, instead of the
+// resolver of the system
+func newResolver(server string) *net.Resolver {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, server)
+		},
+	}
+}
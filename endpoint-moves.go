@@ -0,0 +1,148 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+// Copyright 2020 Opsdis AB
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+)
+
+// endpointTrackers hold the endpoint locations and move counts by fabric name, kept between the scrapes
+var endpointTrackers = struct {
+	sync.Mutex
+	fabrics map[string]*endpointTracker
+}{fabrics: make(map[string]*endpointTracker)}
+
+// endpointTracker keep the last seen locations of the endpoints of a fabric and the number of moves by bridge domain
+type endpointTracker struct {
+	// The locations of an endpoint, keyed by <bd vnid>/<mac>, as the sorted <nodeid>/<interface> where it is local
+	locations map[string][]string
+	// The number of moves, keyed by tenant and bridge domain
+	moves map[tenantBd]int
+}
+
+type tenantBd struct {
+	tenant string
+	bd     string
+}
+
+// update the locations of the endpoints and count the endpoints that moved since the last update. An endpoint is
+// moved if it is not learned on any of the previous locations, so an endpoint on a vpc that is lost on one of the vpc
+// peers is not counted as a move
+func (t *endpointTracker) update(locations map[string][]string, bds map[string]tenantBd) {
+	for key, current := range locations {
+		previous, ok := t.locations[key]
+		if !ok {
+			continue
+		}
+		moved := true
+		for _, location := range current {
+			if contains(previous, location) {
+				moved = false
+				break
+			}
+		}
+		if moved {
+			if bd, ok := bds[strings.SplitN(key, "/", 2)[0]]; ok {
+				t.moves[bd]++
+			}
+		}
+	}
+	t.locations = locations
+}
+
+// endpointMoves return the number of endpoint moves by tenant and bridge domain. The moves are found by comparing the
+// locations of the locally learned mac endpoints on the leafs with the previous scrape, so a mac that move and move
+// back between two scrapes is not counted. Frequent moves, mac flapping, is a sign of a layer 2 loop
+func (p aciAPI) endpointMoves(ch chan []MetricDefinition) {
+	bds, err := p.queryer.getByClassQuery("fvBD", "")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error("endpoint_moves not supported", err)
+		ch <- nil
+		return
+	}
+
+	endpoints, err := p.queryer.getByClassQuery("epmMacEp", "?query-target-filter=wcard(epmMacEp.flags,\"local\")")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"requestid": p.ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", p.ctx.Value("fabric")),
+		}).Error("endpoint_moves not supported", err)
+		ch <- nil
+		return
+	}
+
+	// The tenant and bridge domain of each bridge domain vnid
+	bridgeDomains := make(map[string]tenantBd)
+	gjson.Get(bds, builtinPath("endpoint_moves", "bridge_domains", "imdata.#.fvBD.attributes")).ForEach(func(key, value gjson.Result) bool {
+		labels := parseLabels(value.Get("dn").Str, "^uni/tn-(?P<tenant>[^/]+)/BD-(?P<bd>[^/]+)$")
+		if len(labels) == 0 {
+			return true
+		}
+		bridgeDomains[value.Get("seg").Str] = tenantBd{tenant: labels["tenant"], bd: labels["bd"]}
+		return true
+	})
+
+	locations := make(map[string][]string)
+	gjson.Get(endpoints, builtinPath("endpoint_moves", "endpoints", "imdata.#.epmMacEp.attributes")).ForEach(func(key, value gjson.Result) bool {
+		labels := parseLabels(value.Get("dn").Str, "^topology/pod-[1-9][0-9]*/node-(?P<nodeid>[1-9][0-9]*)/.*/bd-\\[vxlan-(?P<vnid>[0-9]+)\\]/")
+		if len(labels) == 0 {
+			return true
+		}
+		endpoint := labels["vnid"] + "/" + value.Get("addr").Str
+		locations[endpoint] = append(locations[endpoint], labels["nodeid"]+"/"+value.Get("ifId").Str)
+		return true
+	})
+	for _, l := range locations {
+		sort.Strings(l)
+	}
+
+	fabric := fmt.Sprintf("%v", p.ctx.Value("fabric"))
+	endpointTrackers.Lock()
+	defer endpointTrackers.Unlock()
+	tracker, ok := endpointTrackers.fabrics[fabric]
+	if !ok {
+		tracker = &endpointTracker{moves: make(map[tenantBd]int)}
+		endpointTrackers.fabrics[fabric] = tracker
+	}
+	tracker.update(locations, bridgeDomains)
+
+	metricDefinition := MetricDefinition{}
+	metricDefinition.Name = "endpoint_moves"
+	metricDefinition.Description = MetricDesc{
+		Help: "Returns the number of endpoint moves seen between the scrapes by tenant and bridge domain",
+		Type: "counter",
+		Unit: "",
+	}
+
+	// Include all bridge domains, so the counters exist before the first move
+	for _, bd := range bridgeDomains {
+		metric := Metric{}
+		metric.Labels = make(map[string]string)
+		metric.Labels["tenant"] = bd.tenant
+		metric.Labels["bd"] = bd.bd
+		metric.Value = float64(tracker.moves[bd])
+		metricDefinition.Metrics = append(metricDefinition.Metrics, metric)
+	}
+
+	ch <- []MetricDefinition{metricDefinition}
+}
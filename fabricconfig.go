@@ -13,8 +13,92 @@
 
 package main
 
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
 type Fabric struct {
 	Username string
 	Password string
 	Apic     []string
+	Headers  map[string]string
+	// The type of fabric, onprem or cloud, that select the queries executed for the fabric
+	Type string
+	// The login domain of the user, like a LDAP or TACACS domain, empty for the default domain
+	LoginDomain string
+	// The hardware generation of the fabric, that select the max endpoints of endpoint_scale, empty if not configured
+	HardwareGeneration string
+}
+
+// loginName return the user name used to login, prefixed with the login domain if set
+func (f Fabric) loginName() string {
+	if f.LoginDomain == "" {
+		return f.Username
+	}
+	return fmt.Sprintf("apic#%s\\%s", f.LoginDomain, f.Username)
+}
+
+// fabricEnv return the value of the environment variable ACI_<FABRIC>_<NAME> that override a setting of the fabric
+// profile, and if it is set. The fabric name is in uppercase with any character other than a letter or digit as _,
+// so the password of the fabric profile-fabric-01 is ACI_PROFILE_FABRIC_01_PASSWORD
+func fabricEnv(fabric string, name string) (string, bool) {
+	envName := strings.Map(func(r rune) rune {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, strings.ToUpper(fmt.Sprintf("aci_%s_%s", fabric, name)))
+	return os.LookupEnv(envName)
+}
+
+// apicURL return the url of the apic with an IPv6 address in brackets, like https://[2001:db8::1], so a port or path
+// can be added to the url. The zone of a link-local address, like fe80::1%eth0, is escaped as %25 in the url.
+// Hostnames, IPv4 addresses and already bracketed addresses are returned unchanged
+func apicURL(apic string) string {
+	scheme := ""
+	host := apic
+	if i := strings.Index(apic, "://"); i >= 0 {
+		scheme = apic[:i+3]
+		host = apic[i+3:]
+	}
+	path := ""
+	if i := strings.Index(host, "/"); i >= 0 {
+		path = host[i:]
+		host = host[:i]
+	}
+	if strings.HasPrefix(host, "[") {
+		return apic
+	}
+	address := host
+	zone := ""
+	if i := strings.Index(host, "%"); i >= 0 {
+		address = host[:i]
+		zone = host[i:]
+		if !strings.HasPrefix(zone, "%25") {
+			zone = "%25" + zone[1:]
+		}
+	}
+	if strings.Contains(address, ":") && net.ParseIP(address) != nil {
+		return fmt.Sprintf("%s[%s%s]%s", scheme, address, zone, path)
+	}
+	return apic
+}
+
+const (
+	// FabricTypeOnPrem an on-premises aci fabric
+	FabricTypeOnPrem = "onprem"
+	// FabricTypeCloud a Cloud APIC fabric
+	FabricTypeCloud = "cloud"
+)
+
+// supportsFabricType return true if the queries for the fabric types can be executed on the fabric type. If no
+// fabric types are set the queries are for on-premises fabrics
+func supportsFabricType(fabricTypes []string, fabricType string) bool {
+	if len(fabricTypes) == 0 {
+		return fabricType == FabricTypeOnPrem
+	}
+	return contains(fabricTypes, fabricType)
 }
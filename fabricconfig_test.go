@@ -0,0 +1,58 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+// Copyright 2020 Opsdis AB
+
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestApicURL(t *testing.T) {
+	tests := []struct {
+		apic     string
+		expected string
+		host     string
+	}{
+		{apic: "https://2001:db8::1", expected: "https://[2001:db8::1]", host: "2001:db8::1"},
+		{apic: "https://2001:db8::1/", expected: "https://[2001:db8::1]/", host: "2001:db8::1"},
+		{apic: "https://[2001:db8::1]:8443", expected: "https://[2001:db8::1]:8443", host: "2001:db8::1"},
+		{apic: "https://apic1:443", expected: "https://apic1:443", host: "apic1"},
+		{apic: "https://apic1", expected: "https://apic1", host: "apic1"},
+		{apic: "https://10.0.0.1:8443", expected: "https://10.0.0.1:8443", host: "10.0.0.1"},
+		{apic: "2001:db8::1", expected: "[2001:db8::1]"},
+		{apic: "https://fe80::1%eth0", expected: "https://[fe80::1%25eth0]", host: "fe80::1%eth0"},
+		{apic: "https://fe80::1%25eth0", expected: "https://[fe80::1%25eth0]", host: "fe80::1%eth0"},
+		{apic: "fe80::1%eth0", expected: "[fe80::1%25eth0]"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.apic, func(t *testing.T) {
+			actual := apicURL(test.apic)
+			if actual != test.expected {
+				t.Fatalf("got %s, expected %s", actual, test.expected)
+			}
+			if test.host == "" {
+				return
+			}
+			// The url must be usable, with the address as the host
+			parsed, err := url.Parse(actual)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if parsed.Hostname() != test.host {
+				t.Errorf("got host %s, expected %s", parsed.Hostname(), test.host)
+			}
+		})
+	}
+}
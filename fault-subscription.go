@@ -0,0 +1,272 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+// Copyright 2020 Opsdis AB
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tidwall/gjson"
+)
+
+// faultSubscriptions hold the fault subscriptions by fabric name, only fabrics configured with
+// fault_subscription are included
+var faultSubscriptions = make(map[string]*faultSubscription)
+
+// faultSubscription maintain a fault state of a fabric from a websocket subscription on the faultInst class
+type faultSubscription struct {
+	fabric       string
+	fabricConfig Fabric
+	mutex        sync.RWMutex
+	faults       map[string]map[string]string
+	synced       bool
+}
+
+func newFaultSubscription(fabric string, fabricConfig Fabric) *faultSubscription {
+	return &faultSubscription{
+		fabric:       fabric,
+		fabricConfig: fabricConfig,
+		faults:       make(map[string]map[string]string),
+	}
+}
+
+// run the subscription and reconnect if the subscription fails
+func (s *faultSubscription) run() {
+	retry := viper.GetDuration("fault_subscription.retry_interval") * time.Second
+	for {
+		err := s.subscribe()
+		s.mutex.Lock()
+		s.synced = false
+		s.mutex.Unlock()
+		if isLoginError(err) {
+			log.WithFields(log.Fields{
+				"fabric": s.fabric,
+			}).Error(fmt.Sprintf("fault subscription stopped, the login is not retried - %s", err))
+			return
+		}
+		log.WithFields(log.Fields{
+			"fabric": s.fabric,
+		}).Error(fmt.Sprintf("fault subscription failed, reconnect in %s - %s", retry, err))
+		time.Sleep(retry)
+	}
+}
+
+func (s *faultSubscription) subscribe() error {
+	ctx := context.WithValue(context.Background(), "fabric", s.fabric)
+	con := newAciConnction(ctx, s.fabricConfig)
+
+	err := con.login()
+	if err != nil {
+		return err
+	}
+	defer con.logout()
+
+	apic, err := url.Parse(con.activeApic())
+	if err != nil {
+		return err
+	}
+
+	// The websocket is authenticated by the token of the login session
+	token := ""
+	for _, cookie := range con.Client.Jar.Cookies(apic) {
+		if cookie.Name == "APIC-cookie" {
+			token = cookie.Value
+		}
+	}
+	if token == "" {
+		return fmt.Errorf("no session token after login")
+	}
+
+	socketURL := *apic
+	socketURL.Scheme = "wss"
+	if apic.Scheme == "http" {
+		socketURL.Scheme = "ws"
+	}
+	socketURL.Path = "/socket" + token
+
+	dialer := websocket.Dialer{
+		TLSClientConfig:  &tls.Config{InsecureSkipVerify: viper.GetBool("httpclient.insecureHTTPS")},
+		HandshakeTimeout: 10 * time.Second,
+	}
+	header := http.Header{}
+	for k, v := range con.Headers {
+		header.Set(k, v)
+	}
+	socket, _, err := dialer.Dial(socketURL.String(), header)
+	if err != nil {
+		return err
+	}
+	defer socket.Close()
+
+	// The subscription query return the current faults and the id of the subscription
+	refreshTimeout := viper.GetInt("fault_subscription.refresh_timeout")
+	data, err := con.get("faultInst", fmt.Sprintf("%s/api/class/faultInst.json?subscription=yes&refresh-timeout=%d",
+		con.activeApic(), refreshTimeout))
+	if err != nil {
+		return err
+	}
+	subscriptionID := gjson.GetBytes(data, "subscriptionId").String()
+	if subscriptionID == "" {
+		return fmt.Errorf("no subscription id returned")
+	}
+
+	s.mutex.Lock()
+	s.faults = make(map[string]map[string]string)
+	s.mutex.Unlock()
+	s.update(string(data))
+	s.mutex.Lock()
+	s.synced = true
+	s.mutex.Unlock()
+
+	log.WithFields(log.Fields{
+		"fabric":       s.fabric,
+		"subscription": subscriptionID,
+	}).Info("fault subscription established")
+
+	events := make(chan error, 1)
+	go func() {
+		for {
+			_, message, err := socket.ReadMessage()
+			if err != nil {
+				events <- err
+				return
+			}
+			s.update(string(message))
+		}
+	}()
+
+	// Refresh the subscription and the session before they time out
+	subscriptionRefresh := time.NewTicker(time.Duration(refreshTimeout/2) * time.Second)
+	defer subscriptionRefresh.Stop()
+	sessionRefresh := time.NewTicker(viper.GetDuration("fault_subscription.session_refresh") * time.Second)
+	defer sessionRefresh.Stop()
+
+	for {
+		select {
+		case err := <-events:
+			return err
+		case <-subscriptionRefresh.C:
+			_, err := con.get("subscriptionRefresh", fmt.Sprintf("%s/api/subscriptionRefresh.json?id=%s",
+				con.activeApic(), subscriptionID))
+			if err != nil {
+				return err
+			}
+		case <-sessionRefresh.C:
+			err := con.refresh()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// update the fault state with the fault instances of a query response or a subscription event
+func (s *faultSubscription) update(data string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	gjson.Get(data, "imdata.#.faultInst.attributes").ForEach(func(key, value gjson.Result) bool {
+		dn := value.Get("dn").Str
+		if value.Get("status").Str == "deleted" {
+			delete(s.faults, dn)
+			return true
+		}
+		// Modified events only include the changed attributes
+		fault, ok := s.faults[dn]
+		if !ok {
+			fault = make(map[string]string)
+			s.faults[dn] = fault
+		}
+		value.ForEach(func(attribute, attributeValue gjson.Result) bool {
+			fault[attribute.Str] = attributeValue.Str
+			return true
+		})
+		return true // keep iterating
+	})
+}
+
+// isSynced return true if the fault state reflect the current faults of the fabric
+func (s *faultSubscription) isSynced() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.synced
+}
+
+// metrics return the faults and faults_acked metrics from the fault state
+func (s *faultSubscription) metrics() []MetricDefinition {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	type typeSeverity struct {
+		faultType string
+		severity  string
+	}
+	counts := make(map[typeSeverity]int)
+	ackedCounts := make(map[typeSeverity]int)
+
+	severities := viper.GetStringSlice("builtin_queries.faults.severities")
+	for _, fault := range s.faults {
+		severity, ok := faultSeverities[fault["severity"]]
+		if !ok || !contains(severities, severity) {
+			continue
+		}
+		key := typeSeverity{faultType: fault["type"], severity: severity}
+		counts[key]++
+		if fault["ack"] == "yes" {
+			ackedCounts[key]++
+		}
+	}
+
+	metricDefinitionFaults := MetricDefinition{}
+	metricDefinitionFaults.Name = "faults"
+	metricDefinitionFaults.Description = MetricDesc{
+		Help: "Returns the total number of faults by type",
+		Type: "gauge",
+		Unit: "",
+	}
+
+	metricDefinitionAcked := MetricDefinition{}
+	metricDefinitionAcked.Name = "faults_acked"
+	metricDefinitionAcked.Description = MetricDesc{
+		Help: "Returns the total number of acknowledged faults by type",
+		Type: "gauge",
+		Unit: "",
+	}
+
+	for key, count := range counts {
+		metric := Metric{}
+		metric.Labels = make(map[string]string)
+		metric.Labels["type"] = key.faultType
+		metric.Labels["severity"] = key.severity
+		metric.Value = float64(count)
+		metricDefinitionFaults.Metrics = append(metricDefinitionFaults.Metrics, metric)
+
+		metric = Metric{}
+		metric.Labels = make(map[string]string)
+		metric.Labels["type"] = key.faultType
+		metric.Labels["severity"] = key.severity
+		metric.Value = float64(ackedCounts[key])
+		metricDefinitionAcked.Metrics = append(metricDefinitionAcked.Metrics, metric)
+	}
+
+	return []MetricDefinition{metricDefinitionFaults, metricDefinitionAcked}
+}
@@ -0,0 +1,119 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+// Copyright 2020 Opsdis AB
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	SetDefaultValues()
+	os.Exit(m.Run())
+}
+
+// fixtureQueryer return canned apic responses instead of the apic. The responses are keyed on the api path and the
+// query parameters of the request, like /api/class/topSystem.json?rsp-subtree-include=health, so the count-only,
+// paged and filtered requests of a class get their own response. A request without a response fail
+type fixtureQueryer struct {
+	urlMap    map[string]string
+	responses map[string]string
+}
+
+func (f fixtureQueryer) getByQuery(table string) (string, error) {
+	return f.get(f.urlMap[table])
+}
+
+func (f fixtureQueryer) getByClassQuery(class string, query string) (string, error) {
+	return f.get(fmt.Sprintf("/api/class/%s.json%s", class, query))
+}
+
+func (f fixtureQueryer) getByDnQuery(dn string, query string) (string, error) {
+	return f.get(fmt.Sprintf("/api/mo/%s.json%s", dn, query))
+}
+
+func (f fixtureQueryer) getByNodeClassQuery(node string, class string, query string) (string, error) {
+	return f.get(fmt.Sprintf("/api/node/class/%s/%s.json%s", node, class, query))
+}
+
+func (f fixtureQueryer) get(path string) (string, error) {
+	data, ok := f.responses[path]
+	if !ok {
+		return "", fmt.Errorf("no fixture for %s", path)
+	}
+	return data, nil
+}
+
+// newFixtureAPI return an api that read the apic responses from the fixtures, keyed as by fixtureQueryer
+func newFixtureAPI(responses map[string]string) aciAPI {
+	ctx := context.WithValue(context.Background(), "fabric", "test")
+	ctx = context.WithValue(ctx, "requestid", "test")
+	connection := *newAciConnction(ctx, Fabric{})
+	return aciAPI{
+		ctx:        ctx,
+		connection: connection,
+		queryer:    fixtureQueryer{urlMap: connection.URLMap, responses: responses},
+		stats:      newQueryStats(),
+	}
+}
+
+// runQuery execute a built-in query, or a configured query wrapped in a function, and return its metrics
+func runQuery(api aciAPI, query func(aciAPI, chan []MetricDefinition)) []MetricDefinition {
+	ch := make(chan []MetricDefinition)
+	go query(api, ch)
+	return <-ch
+}
+
+// seriesValues return the values of the series of the named metric by their labels, formatted as by seriesKey
+func seriesValues(metrics []MetricDefinition, name string) map[string]float64 {
+	values := make(map[string]float64)
+	for _, metricDefinition := range metrics {
+		if metricDefinition.Name != name {
+			continue
+		}
+		for _, metric := range metricDefinition.Metrics {
+			values[seriesKey(metric.Labels)] = metric.Value
+		}
+	}
+	return values
+}
+
+// seriesKey format the labels of a series sorted by name, like nodeid=101,podid=1
+func seriesKey(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for name, value := range labels {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// assertSeries fail the test if the series of the metric are not exactly the expected
+func assertSeries(t *testing.T, metrics []MetricDefinition, name string, expected map[string]float64) {
+	t.Helper()
+	actual := seriesValues(metrics, name)
+	if len(actual) != len(expected) {
+		t.Errorf("%s: got %d series %v, expected %d series %v", name, len(actual), actual, len(expected), expected)
+		return
+	}
+	for key, value := range expected {
+		if got, ok := actual[key]; !ok || got != value {
+			t.Errorf("%s{%s}: got %v (found %v), expected %v", name, key, got, ok, value)
+		}
+	}
+}
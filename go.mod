@@ -4,10 +4,13 @@ go 1.13
 
 require (
 	github.com/Knetic/govaluate v3.0.0+incompatible
+	github.com/golang/snappy v0.0.1
+	github.com/gorilla/websocket v1.4.2
 	github.com/prometheus/client_golang v1.7.1
 	github.com/segmentio/ksuid v1.0.3
 	github.com/sirupsen/logrus v1.6.0
 	github.com/spf13/viper v1.7.0
 	github.com/tidwall/gjson v1.9.3
 	github.com/umisama/go-regexpcache v0.0.0-20150417035358-2444a542492f
+	google.golang.org/protobuf v1.23.0
 )
@@ -18,16 +18,30 @@ import (
 	"crypto/x509"
 	"net"
 	"net/http"
+	"sync"
 	"time"
 )
 
+// transport is shared by all clients so connections to the apic are reused between requests and scrapes
+var (
+	transport     *http.Transport
+	transportOnce sync.Once
+)
+
 // HTTPClient used for retrieve data from a HTTP based api
 type HTTPClient struct {
 	InsecureHTTPS       bool
 	Timeout             int
 	Keepalive           int
 	Tlshandshaketimeout int
-	cookieJar           http.CookieJar
+	// Seconds to wait for the response headers after the request is sent, 0 is no timeout
+	ResponseHeaderTimeout int
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+	IdleConnTimeout       int
+	DNSCacheTTL           int
+	Resolver              string
+	cookieJar             http.CookieJar
 }
 
 // GetJar return the the client jar
@@ -70,22 +84,42 @@ func (c HTTPClient) GetClient() *http.Client {
 		}
 	*/
 	//
-	var client = &http.Client{
-		Timeout: time.Duration(c.Timeout) * time.Second,
-		Transport: &http.Transport{
-			DialContext: (&net.Dialer{
-				//Timeout:   time.Duration(c.Timeout) * time.Second,
-				KeepAlive: time.Duration(c.Keepalive) * time.Second,
-			}).DialContext,
-			//TLSHandshakeTimeout: time.Duration(c.Tlshandshaketimeout) * time.Second,
+	transportOnce.Do(func() {
+		dialer := &net.Dialer{
+			//Timeout:   time.Duration(c.Timeout) * time.Second,
+			KeepAlive: time.Duration(c.Keepalive) * time.Second,
+		}
+		if c.Resolver != "" {
+			dialer.Resolver = newResolver(c.Resolver)
+		}
+		dial := dialer.DialContext
+		if c.DNSCacheTTL > 0 {
+			resolver := dialer.Resolver
+			if resolver == nil {
+				resolver = net.DefaultResolver
+			}
+			dial = newDNSCache(resolver, time.Duration(c.DNSCacheTTL)*time.Second).dialContext(dialer)
+		}
+
+		transport = &http.Transport{
+			DialContext:         dial,
+			TLSHandshakeTimeout: time.Duration(c.Tlshandshaketimeout) * time.Second,
 			TLSClientConfig: &tls.Config{
 				InsecureSkipVerify: c.InsecureHTTPS,
 				//RootCAs:            rootCAs,
 			},
+			MaxIdleConns:        c.MaxIdleConns,
+			MaxIdleConnsPerHost: c.MaxIdleConnsPerHost,
+			IdleConnTimeout:     time.Duration(c.IdleConnTimeout) * time.Second,
 			//ExpectContinueTimeout: 4 * time.Second,
-			//ResponseHeaderTimeout: 3 * time.Second,
-		},
-		Jar: c.cookieJar,
+			ResponseHeaderTimeout: time.Duration(c.ResponseHeaderTimeout) * time.Second,
+		}
+	})
+
+	var client = &http.Client{
+		Timeout:   time.Duration(c.Timeout) * time.Second,
+		Transport: transport,
+		Jar:       c.cookieJar,
 	}
 	return client
 }
@@ -0,0 +1,121 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+// Copyright 2020 Opsdis AB
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// PathSyntaxGjson the paths of a query are gjson paths, the default
+	PathSyntaxGjson = "gjson"
+	// PathSyntaxJSONPath the paths of a query are JSONPath expressions
+	PathSyntaxJSONPath = "jsonpath"
+)
+
+// jsonPathFilter is a JSONPath filter expression like [?(@.attributes.operSt == 'up')]
+var jsonPathFilter = regexp.MustCompile(`^\[\?\(@\.([A-Za-z0-9_.\-]+)\s*(==|!=|<=|>=|<|>)\s*(.+?)\s*\)\]`)
+
+// jsonPathToGjson translate a JSONPath expression to the gjson path that select the same value, so the queries can
+// be written with either syntax and the exporter only evaluate gjson paths. The root $ is the object the gjson path
+// is relative to, like an object of imdata for the value_name of a class query. Supported are child names in dot or
+// bracket notation, array indexes, the wildcard * and filters comparing a member with a value. Recursive descent,
+// slices, unions, an index of the result of a filter and the root $ alone are not supported
+func jsonPathToGjson(path string) (string, error) {
+	if !strings.HasPrefix(path, "$") {
+		return "", fmt.Errorf("jsonpath %s must start with $", path)
+	}
+	rest := path[1:]
+	if rest == "" {
+		return "", fmt.Errorf("jsonpath %s - the root alone is not supported", path)
+	}
+	var parts []string
+	// A gjson filter query apply the following parts to each match, so an index after a filter would index each match
+	// instead of the matches
+	filtered := false
+	for rest != "" {
+		switch {
+		case strings.HasPrefix(rest, ".."):
+			return "", fmt.Errorf("jsonpath %s - recursive descent is not supported", path)
+		case strings.HasPrefix(rest, ".*"):
+			parts = append(parts, "*")
+			rest = rest[2:]
+		case strings.HasPrefix(rest, "."):
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			if end == 0 {
+				return "", fmt.Errorf("jsonpath %s - empty name", path)
+			}
+			parts = append(parts, escapeGjson(rest[1:end+1]))
+			rest = rest[end+1:]
+		case strings.HasPrefix(rest, "['") || strings.HasPrefix(rest, "[\""):
+			quote := rest[1:2]
+			end := strings.Index(rest[2:], quote+"]")
+			if end < 0 {
+				return "", fmt.Errorf("jsonpath %s - name not terminated", path)
+			}
+			parts = append(parts, escapeGjson(rest[2:end+2]))
+			rest = rest[end+4:]
+		case strings.HasPrefix(rest, "[?("):
+			match := jsonPathFilter.FindStringSubmatch(rest)
+			if match == nil {
+				return "", fmt.Errorf("jsonpath %s - filter not supported", path)
+			}
+			value := match[3]
+			if len(value) >= 2 && (value[0] == '\'' || value[0] == '"') && value[len(value)-1] == value[0] {
+				value = strconv.Quote(value[1 : len(value)-1])
+			}
+			parts = append(parts, fmt.Sprintf("#(%s%s%s)#", match[1], match[2], value))
+			rest = rest[len(match[0]):]
+			filtered = true
+		case strings.HasPrefix(rest, "["):
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return "", fmt.Errorf("jsonpath %s - [ not terminated", path)
+			}
+			index := strings.TrimSpace(rest[1:end])
+			if index == "*" {
+				parts = append(parts, "#")
+			} else if _, err := strconv.Atoi(index); err == nil {
+				if filtered {
+					return "", fmt.Errorf("jsonpath %s - index %s of a filter not supported", path, index)
+				}
+				parts = append(parts, index)
+			} else {
+				return "", fmt.Errorf("jsonpath %s - index %s not supported", path, index)
+			}
+			rest = rest[end+1:]
+		default:
+			return "", fmt.Errorf("jsonpath %s - not valid at %s", path, rest)
+		}
+	}
+	return strings.Join(parts, "."), nil
+}
+
+// escapeGjson escape the characters of a name that have a meaning in a gjson path
+func escapeGjson(name string) string {
+	var escaped strings.Builder
+	for _, r := range name {
+		if strings.ContainsRune(`\.*?|#@!=<>%`, r) {
+			escaped.WriteRune('\\')
+		}
+		escaped.WriteRune(r)
+	}
+	return escaped.String()
+}
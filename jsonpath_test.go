@@ -0,0 +1,68 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+// Copyright 2020 Opsdis AB
+
+package main
+
+import (
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestJSONPathToGjson(t *testing.T) {
+	const data = `{"a":{"items":[{"n":"x","v":1},{"n":"y","v":2},{"n":"y","v":3}],"b.c":4}}`
+	tests := []struct {
+		name     string
+		path     string
+		expected string
+		value    string
+		err      bool
+	}{
+		{name: "dot notation", path: "$.a.items", expected: "a.items"},
+		{name: "bracket notation", path: "$['a'][\"b.c\"]", expected: `a.b\.c`, value: "4"},
+		{name: "index", path: "$.a.items[1].v", expected: "a.items.1.v", value: "2"},
+		{name: "wildcard", path: "$.a.items[*].v", expected: "a.items.#.v", value: "[1,2,3]"},
+		{name: "filter", path: "$.a.items[?(@.n == 'y')].v", expected: `a.items.#(n=="y")#.v`, value: "[2,3]"},
+		{name: "numeric filter", path: "$.a.items[?(@.v > 1)].n", expected: `a.items.#(v>1)#.n`, value: `["y","y"]`},
+		{name: "index of a filter", path: "$.a.items[?(@.n=='y')][0].v", err: true},
+		{name: "root alone", path: "$", err: true},
+		{name: "no root", path: "a.items", err: true},
+		{name: "recursive descent", path: "$..v", err: true},
+		{name: "slice", path: "$.a.items[0:2]", err: true},
+		{name: "empty name", path: "$.a.", err: true},
+		{name: "name not terminated", path: "$['a", err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual, err := jsonPathToGjson(test.path)
+			if test.err {
+				if err == nil {
+					t.Errorf("%s: got %s, expected an error", test.path, actual)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("%s: %s", test.path, err)
+			}
+			if actual != test.expected {
+				t.Errorf("%s: got %s, expected %s", test.path, actual, test.expected)
+			}
+			if test.value != "" {
+				if value := gjson.Get(data, actual).Raw; value != test.value {
+					t.Errorf("%s: got value %s, expected %s", test.path, value, test.value)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+// Copyright 2020 Opsdis AB
+
+package main
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// MetricProcessor process the metrics of a fabric after all queries are done and before the metrics are renamed and
+// returned. A processor can add, drop or modify metrics, like a ratio calculated from two other metrics, without
+// changing the queries. A processor is compiled into the exporter, in its own file, and registered from an init
+// function with registerMetricProcessor
+type MetricProcessor interface {
+	// Name of the processor, used to enable or disable it with metric_processors.<name>.enabled
+	Name() string
+	// Process return the processed metrics of the fabric. If an error is returned the metrics are not changed
+	Process(fabric string, metrics []MetricDefinition) ([]MetricDefinition, error)
+}
+
+// metricProcessors are the registered processors, executed in the order they were registered
+var metricProcessors []MetricProcessor
+
+// registerMetricProcessor add a processor executed on the metrics of every scrape. Must only be called from an init
+// function, since the processors are not guarded for concurrent access
+func registerMetricProcessor(processor MetricProcessor) {
+	metricProcessors = append(metricProcessors, processor)
+}
+
+// processMetrics execute the enabled processors on the metrics of the scrape
+func (p aciAPI) processMetrics(metrics []MetricDefinition) []MetricDefinition {
+	fabric := fmt.Sprintf("%v", p.ctx.Value("fabric"))
+	for _, processor := range metricProcessors {
+		if !viper.GetBool(fmt.Sprintf("metric_processors.%s.enabled", processor.Name())) {
+			continue
+		}
+		processed, err := processor.Process(fabric, metrics)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"requestid": p.ctx.Value("requestid"),
+				"fabric":    fabric,
+			}).Error(fmt.Sprintf("metric processor %s failed - %s", processor.Name(), err))
+			continue
+		}
+		metrics = processed
+	}
+	return metrics
+}
@@ -17,6 +17,7 @@ import (
 	"fmt"
 	"sort"
 	"strings"
+	"time"
 )
 
 /*
@@ -38,36 +39,52 @@ type MetricDesc struct {
 */
 
 type MetricDefinition struct {
-	Name        string // the name of the metrics
-	Metrics     []Metric
-	Description MetricDesc
+	Name        string     `json:"name"` // the name of the metrics
+	Metrics     []Metric   `json:"metrics"`
+	Description MetricDesc `json:"description"`
 }
 
 // Metric the value, labels and timestamp of the metrics
 type Metric struct {
-	Value     float64
-	Labels    map[string]string
-	Timestamp float64
+	Value     float64           `json:"value"`
+	Labels    map[string]string `json:"labels"`
+	Timestamp float64           `json:"timestamp,omitempty"`
 }
 
 // MetricDesc the Prometheus help and type text
 type MetricDesc struct {
-	Help string
-	Type string
-	Unit string
+	Help string `json:"help"`
+	Type string `json:"type"`
+	Unit string `json:"unit"`
 }
 
-// Labels2Prometheus create a string of all labels, sorted by label name
+// fullName return the name of the metric including the unit and the _total suffix for counters
+func (md MetricDefinition) fullName() string {
+	metricName := md.Name
+	if md.Description.Unit != "" {
+		metricName = md.Name + "_" + md.Description.Unit
+	}
+
+	if md.Description.Type == "counter" && md.Description.Unit != "info" {
+		metricName = metricName + "_total"
+	}
+	return metricName
+}
+
+// Labels2Prometheus create a string of all labels, sorted by label name. The labels of the metric are not changed,
+// since the metrics of a background collection are formatted by concurrent scrapes
 func (m Metric) Labels2Prometheus(commonLabels map[string]string) string {
 	// append all common maps
-	if len(commonLabels) != 0 {
-		for k, v := range commonLabels {
-			m.Labels[k] = v
-		}
+	labels := make(map[string]string, len(m.Labels)+len(commonLabels))
+	for k, v := range m.Labels {
+		labels[k] = v
+	}
+	for k, v := range commonLabels {
+		labels[k] = v
 	}
 
-	keys := make([]string, 0, len(m.Labels))
-	for k := range m.Labels {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
 		keys = append(keys, k)
 	}
 
@@ -77,8 +94,8 @@ func (m Metric) Labels2Prometheus(commonLabels map[string]string) string {
 	sep := ""
 	for _, k := range keys {
 		// Filter out empty labels
-		if m.Labels[k] != "" {
-			labelstr = labelstr + fmt.Sprintf("%s%s=\"%s\"", sep, k, m.Labels[k])
+		if labels[k] != "" {
+			labelstr = labelstr + fmt.Sprintf("%s%s=\"%s\"", sep, k, labels[k])
 			sep = ","
 		}
 	}
@@ -92,14 +109,7 @@ func Metrics2Prometheus(metrics []MetricDefinition, prefix string, commonLabels
 	for _, metricDefinition := range metrics {
 
 		// only format if the metrics slice include items
-		metricName := metricDefinition.Name
-		if metricDefinition.Description.Unit != "" {
-			metricName = metricDefinition.Name + "_" + metricDefinition.Description.Unit
-		}
-
-		if metricDefinition.Description.Type == "counter" && metricDefinition.Description.Unit != "info" {
-			metricName = metricName + "_total"
-		}
+		metricName := metricDefinition.fullName()
 
 		if len(metricDefinition.Metrics) > 0 {
 			promFormat = promFormat + fmt.Sprintf("# HELP %s %s\n", metricName, metricDefinition.Description.Help)
@@ -124,3 +134,42 @@ func Metrics2Prometheus(metrics []MetricDefinition, prefix string, commonLabels
 	}
 	return promFormat
 }
+
+// TimeSeries a single sample of a metric, where the metric name is included in the labels as __name__
+type TimeSeries struct {
+	Labels    map[string]string
+	Value     float64
+	Timestamp int64 // milliseconds since epoch
+}
+
+// Metrics2TimeSeries convert a slice of Metric to time series, all with the same timestamp
+func Metrics2TimeSeries(metrics []MetricDefinition, prefix string, commonLabels map[string]string, timestamp time.Time) []TimeSeries {
+	var timeSeries []TimeSeries
+
+	for _, metricDefinition := range metrics {
+		metricName := prefix + metricDefinition.fullName()
+
+		for _, metric := range metricDefinition.Metrics {
+			labels := make(map[string]string)
+			for k, v := range metric.Labels {
+				// Filter out empty labels
+				if v != "" {
+					labels[k] = v
+				}
+			}
+			for k, v := range commonLabels {
+				if v != "" {
+					labels[k] = v
+				}
+			}
+			labels["__name__"] = metricName
+
+			timeSeries = append(timeSeries, TimeSeries{
+				Labels:    labels,
+				Value:     metric.Value,
+				Timestamp: timestamp.UnixNano() / int64(time.Millisecond),
+			})
+		}
+	}
+	return timeSeries
+}
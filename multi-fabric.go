@@ -0,0 +1,113 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+// Copyright 2020 Opsdis AB
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// fabricsCollector collect the metrics of all fabrics, or the fabrics in multi_fabric.fabrics, when the exporter
+// metrics are scraped, so one scrape return the metrics of several fabrics labeled by fabric. The fabrics are collected
+// concurrently, and a fabric collected in the background return its last collection
+type fabricsCollector struct {
+	fabrics    []string
+	allQueries AllQueries
+}
+
+func newFabricsCollector(allQueries AllQueries) *fabricsCollector {
+	fabrics := viper.GetStringSlice("multi_fabric.fabrics")
+	if len(fabrics) == 0 {
+		for fabric := range viper.GetStringMap("fabrics") {
+			fabrics = append(fabrics, fabric)
+		}
+	}
+	sort.Strings(fabrics)
+	return &fabricsCollector{fabrics: fabrics, allQueries: allQueries}
+}
+
+// Describe send no descriptions, the metrics depend on the queries and the fabrics, so the collector is unchecked
+func (c *fabricsCollector) Describe(ch chan<- *prometheus.Desc) {
+}
+
+// Collect the metrics of the fabrics
+func (c *fabricsCollector) Collect(ch chan<- prometheus.Metric) {
+	var wg sync.WaitGroup
+	for _, fabric := range c.fabrics {
+		wg.Add(1)
+		go func(fabric string) {
+			defer wg.Done()
+			var metrics []MetricDefinition
+			var prefix string
+			var commonLabels map[string]string
+			if latest := collected(fabric); latest != nil {
+				metrics, prefix, commonLabels = latest.metrics, latest.prefix, latest.commonLabels
+			} else {
+				ctx := context.WithValue(context.Background(), "requestid", nextRequestID())
+				metrics, prefix, commonLabels, _ = collectFabric(ctx, fabric, c.allQueries, "")
+			}
+			for _, metric := range constMetrics(metrics, prefix, commonLabels) {
+				ch <- metric
+			}
+		}(fabric)
+	}
+	wg.Wait()
+}
+
+// constMetrics convert the metrics of a fabric to Prometheus metrics, with the common labels added to every series.
+// A series that can not be converted, like one with a label name that is not valid, is logged and left out
+func constMetrics(metrics []MetricDefinition, prefix string, commonLabels map[string]string) []prometheus.Metric {
+	var constMetrics []prometheus.Metric
+	for _, metricDefinition := range metrics {
+		valueType := prometheus.UntypedValue
+		switch metricDefinition.Description.Type {
+		case "counter":
+			valueType = prometheus.CounterValue
+		case "gauge":
+			valueType = prometheus.GaugeValue
+		}
+
+		for _, metric := range metricDefinition.Metrics {
+			labels := make(prometheus.Labels)
+			for k, v := range metric.Labels {
+				// Filter out empty labels
+				if v != "" {
+					labels[k] = v
+				}
+			}
+			for k, v := range commonLabels {
+				if v != "" {
+					labels[k] = v
+				}
+			}
+
+			desc := prometheus.NewDesc(prefix+metricDefinition.fullName(), metricDefinition.Description.Help, nil, labels)
+			constMetric, err := prometheus.NewConstMetric(desc, valueType, metric.Value)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"fabric": commonLabels["fabric"],
+				}).Error(fmt.Sprintf("metric %s can not be exported - %s", metricDefinition.fullName(), err))
+				continue
+			}
+			constMetrics = append(constMetrics, constMetric)
+		}
+	}
+	return constMetrics
+}
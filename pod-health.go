@@ -0,0 +1,103 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+// Copyright 2020 Opsdis AB
+
+package main
+
+import (
+	"math"
+	"sort"
+
+	"github.com/spf13/viper"
+)
+
+func init() {
+	registerMetricProcessor(podHealth{})
+}
+
+// podHealth calculate the average and the lowest health of the nodes of each pod, from the node health of the health
+// query, without any extra query to the apic. The node health is the metric metric_processors.pod_health.metric,
+// default health, with the label class set to metric_processors.pod_health.class, default topSystem
+type podHealth struct{}
+
+func (podHealth) Name() string {
+	return "pod_health"
+}
+
+func (podHealth) Process(fabric string, metrics []MetricDefinition) ([]MetricDefinition, error) {
+	metricName := viper.GetString("metric_processors.pod_health.metric")
+	class := viper.GetString("metric_processors.pod_health.class")
+
+	unit := ""
+	nodeHealth := make(map[string][]float64)
+	for _, metricDefinition := range metrics {
+		if metricDefinition.Name != metricName {
+			continue
+		}
+		for _, metric := range metricDefinition.Metrics {
+			podid, ok := metric.Labels["podid"]
+			if !ok || metric.Labels["class"] != class || metric.Labels["nodeid"] == "" {
+				continue
+			}
+			unit = metricDefinition.Description.Unit
+			nodeHealth[podid] = append(nodeHealth[podid], metric.Value)
+		}
+	}
+	if len(nodeHealth) == 0 {
+		return metrics, nil
+	}
+
+	metricDefinitionAvg := MetricDefinition{}
+	metricDefinitionAvg.Name = "pod_node_health_avg"
+	metricDefinitionAvg.Description = MetricDesc{
+		Help: "Returns the average health score of the nodes of the pod",
+		Type: "gauge",
+		Unit: unit,
+	}
+
+	metricDefinitionMin := MetricDefinition{}
+	metricDefinitionMin.Name = "pod_node_health_min"
+	metricDefinitionMin.Description = MetricDesc{
+		Help: "Returns the lowest health score of the nodes of the pod",
+		Type: "gauge",
+		Unit: unit,
+	}
+
+	var pods []string
+	for podid := range nodeHealth {
+		pods = append(pods, podid)
+	}
+	sort.Strings(pods)
+
+	for _, podid := range pods {
+		sum := 0.0
+		min := math.MaxFloat64
+		for _, health := range nodeHealth[podid] {
+			sum += health
+			min = math.Min(min, health)
+		}
+
+		metric := Metric{}
+		metric.Labels = make(map[string]string)
+		metric.Labels["podid"] = podid
+		metric.Value = roundPrecision(sum / float64(len(nodeHealth[podid])))
+		metricDefinitionAvg.Metrics = append(metricDefinitionAvg.Metrics, metric)
+
+		metric = Metric{}
+		metric.Labels = make(map[string]string)
+		metric.Labels["podid"] = podid
+		metric.Value = min
+		metricDefinitionMin.Metrics = append(metricDefinitionMin.Metrics, metric)
+	}
+
+	return append(metrics, metricDefinitionAvg, metricDefinitionMin), nil
+}
@@ -0,0 +1,162 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+// Copyright 2020 Opsdis AB
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// cache hold the result of the queries configured with a cache ttl, by fabric and query name
+var cache = &queryCache{entries: make(map[string]*cacheEntry)}
+
+type queryCache struct {
+	mutex   sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+type cacheEntry struct {
+	metricDefinitions []MetricDefinition
+	// The statistics of the query, like the number of objects returned by the apic
+	stats      *queryStats
+	timestamp  time.Time
+	refreshing bool
+}
+
+// cachedQuery execute the query, or return the result of the query from the cache if the query has been executed
+// before. A result older than the ttl is still returned, but the query is executed again in the background to
+// refresh the cache, so a slow query do not block the scrape. If the ttl is 0 the query is not cached
+func (p aciAPI) cachedQuery(ch chan []MetricDefinition, name string, ttl int, query func(aciAPI, chan []MetricDefinition)) {
+	if ttl <= 0 {
+		query(p, ch)
+		return
+	}
+
+	key := fmt.Sprintf("%v/%s", p.ctx.Value("fabric"), name)
+
+	cache.mutex.Lock()
+	entry, ok := cache.entries[key]
+	if ok {
+		age := time.Since(entry.timestamp)
+		if age > time.Duration(ttl)*time.Second && !entry.refreshing {
+			entry.refreshing = true
+			go p.refreshCache(key, name, query)
+		}
+		metricDefinitions := copyMetricDefinitions(entry.metricDefinitions)
+		p.stats.addCounts(name, entry.stats)
+		p.stats.setCacheAge(name, age.Seconds())
+		cache.mutex.Unlock()
+
+		p.stats.setSuccess(name, true)
+		ch <- metricDefinitions
+		return
+	}
+	cache.mutex.Unlock()
+
+	// Nothing cached, execute the query as part of the scrape
+	metricDefinitions, stats := p.executeQuery(name, query)
+	if metricDefinitions != nil {
+		cache.mutex.Lock()
+		cache.entries[key] = &cacheEntry{
+			metricDefinitions: copyMetricDefinitions(metricDefinitions),
+			stats:             stats,
+			timestamp:         time.Now(),
+		}
+		cache.mutex.Unlock()
+		p.stats.setCacheAge(name, 0)
+	}
+	p.stats.addCounts(name, stats)
+	p.stats.setSuccess(name, metricDefinitions != nil)
+	ch <- metricDefinitions
+}
+
+// executeQuery execute the query with its own statistics and return the result and the statistics, or nil if the
+// query failed
+func (p aciAPI) executeQuery(name string, query func(aciAPI, chan []MetricDefinition)) ([]MetricDefinition, *queryStats) {
+	api := p
+	api.stats = newQueryStats()
+
+	ch := make(chan []MetricDefinition)
+	go query(api, ch)
+	metricDefinitions := <-ch
+
+	api.stats.mutex.Lock()
+	defer api.stats.mutex.Unlock()
+	if success, ok := api.stats.success[name]; ok && !success {
+		return nil, nil
+	}
+	return metricDefinitions, api.stats
+}
+
+// refreshCache execute the query in the background, with its own login session since the session of the scrape is
+// logged out when the scrape is done
+func (p aciAPI) refreshCache(key string, name string, query func(aciAPI, chan []MetricDefinition)) {
+	ctx := context.WithValue(context.Background(), "fabric", p.ctx.Value("fabric"))
+	ctx = context.WithValue(ctx, "requestid", nextRequestID())
+	ctx = context.WithValue(ctx, "query", name)
+
+	api := p
+	api.ctx = ctx
+
+	var metricDefinitions []MetricDefinition
+	var stats *queryStats
+	api.connection = *newAciConnction(ctx, p.connection.fabricConfig)
+	api.queryer = api.connection
+	err := api.connection.login()
+	if err == nil {
+		metricDefinitions, stats = api.executeQuery(name, query)
+	}
+	api.connection.logout()
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	entry := cache.entries[key]
+	entry.refreshing = false
+	if metricDefinitions == nil {
+		// Keep the stale result and try again on the next scrape
+		log.WithFields(log.Fields{
+			"requestid": ctx.Value("requestid"),
+			"fabric":    fmt.Sprintf("%v", ctx.Value("fabric")),
+		}).Error(fmt.Sprintf("refresh of cached query %s failed", name))
+		return
+	}
+	entry.metricDefinitions = copyMetricDefinitions(metricDefinitions)
+	entry.stats = stats
+	entry.timestamp = time.Now()
+}
+
+// copyMetricDefinitions return a deep copy, since the labels of the metrics are modified when the metrics are
+// formatted
+func copyMetricDefinitions(metricDefinitions []MetricDefinition) []MetricDefinition {
+	if metricDefinitions == nil {
+		return nil
+	}
+	copies := make([]MetricDefinition, len(metricDefinitions))
+	for i, metricDefinition := range metricDefinitions {
+		copies[i] = metricDefinition
+		copies[i].Metrics = make([]Metric, len(metricDefinition.Metrics))
+		for j, metric := range metricDefinition.Metrics {
+			copies[i].Metrics[j] = metric
+			copies[i].Metrics[j].Labels = make(map[string]string)
+			for k, v := range metric.Labels {
+				copies[i].Metrics[j].Labels[k] = v
+			}
+		}
+	}
+	return copies
+}
@@ -0,0 +1,236 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+// Copyright 2020 Opsdis AB
+
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// queryStats collect statistics of the configured queries executed during a scrape
+type queryStats struct {
+	mutex       sync.Mutex
+	resultCount map[string]int
+	success     map[string]bool
+	cacheAge    map[string]float64
+	// The number of series dropped by the sampling of the query
+	seriesDropped map[string]int
+	// The size of the response bodies received from the apic by the query
+	responseBytes map[string]int
+}
+
+func newQueryStats() *queryStats {
+	return &queryStats{
+		resultCount:   make(map[string]int),
+		success:       make(map[string]bool),
+		cacheAge:      make(map[string]float64),
+		seriesDropped: make(map[string]int),
+		responseBytes: make(map[string]int),
+	}
+}
+
+// setSuccess set if a query was successful. A query that include multiple apic queries is only successful if all
+// are successful
+func (s *queryStats) setSuccess(query string, success bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if previous, ok := s.success[query]; ok && !previous {
+		return
+	}
+	s.success[query] = success
+}
+
+// succeeded return true if the query was successful
+func (s *queryStats) succeeded(query string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.success[query]
+}
+
+// setUnfinished set the queries that have no success set, since they did not finish, as not successful
+func (s *queryStats) setUnfinished(queries []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, query := range queries {
+		if _, ok := s.success[query]; !ok {
+			s.success[query] = false
+		}
+	}
+}
+
+// addResultCount add the number of objects returned by a query
+func (s *queryStats) addResultCount(query string, count int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.resultCount[query] += count
+}
+
+// addSeriesDropped add the number of series dropped by the sampling of the query
+func (s *queryStats) addSeriesDropped(query string, count int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.seriesDropped[query] += count
+}
+
+// addResponseBytes add the size of a response body received from the apic by a query
+func (s *queryStats) addResponseBytes(query string, bytes int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.responseBytes[query] += bytes
+}
+
+// addCounts add the number of objects and the series dropped of the query from the statistics of the query when it was
+// executed, for a cached query
+func (s *queryStats) addCounts(query string, from *queryStats) {
+	if from == nil {
+		return
+	}
+	from.mutex.Lock()
+	resultCount := from.resultCount[query]
+	seriesDropped, sampled := from.seriesDropped[query]
+	from.mutex.Unlock()
+
+	s.addResultCount(query, resultCount)
+	if sampled {
+		s.addSeriesDropped(query, seriesDropped)
+	}
+}
+
+// setCacheAge set the age in seconds of the result of a cached query
+func (s *queryStats) setCacheAge(query string, age float64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.cacheAge[query] = age
+}
+
+// metrics return the statistics as metrics
+func (s *queryStats) metrics() []MetricDefinition {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	metricDefinition := MetricDefinition{}
+	metricDefinition.Name = "query_result_count"
+	metricDefinition.Description = MetricDesc{
+		Help: "Returns the number of objects returned by the apic for the query",
+		Type: "gauge",
+		Unit: "",
+	}
+
+	queries := make([]string, 0, len(s.resultCount))
+	for query := range s.resultCount {
+		queries = append(queries, query)
+	}
+	sort.Strings(queries)
+
+	for _, query := range queries {
+		metric := Metric{}
+		metric.Labels = make(map[string]string)
+		metric.Labels["query"] = query
+		metric.Value = float64(s.resultCount[query])
+		metricDefinition.Metrics = append(metricDefinition.Metrics, metric)
+	}
+
+	metricDefinitionSuccess := MetricDefinition{}
+	metricDefinitionSuccess.Name = "query_success"
+	metricDefinitionSuccess.Description = MetricDesc{
+		Help: "Returns 1 if the query was successful, else 0",
+		Type: "gauge",
+		Unit: "",
+	}
+
+	queries = make([]string, 0, len(s.success))
+	for query := range s.success {
+		queries = append(queries, query)
+	}
+	sort.Strings(queries)
+
+	for _, query := range queries {
+		metric := Metric{}
+		metric.Labels = make(map[string]string)
+		metric.Labels["query"] = query
+		if s.success[query] {
+			metric.Value = 1
+		}
+		metricDefinitionSuccess.Metrics = append(metricDefinitionSuccess.Metrics, metric)
+	}
+
+	metricDefinitionCacheAge := MetricDefinition{}
+	metricDefinitionCacheAge.Name = "query_cache_age"
+	metricDefinitionCacheAge.Description = MetricDesc{
+		Help: "Returns the age of the cached result of the query",
+		Type: "gauge",
+		Unit: "seconds",
+	}
+
+	queries = make([]string, 0, len(s.cacheAge))
+	for query := range s.cacheAge {
+		queries = append(queries, query)
+	}
+	sort.Strings(queries)
+
+	for _, query := range queries {
+		metric := Metric{}
+		metric.Labels = make(map[string]string)
+		metric.Labels["query"] = query
+		metric.Value = s.cacheAge[query]
+		metricDefinitionCacheAge.Metrics = append(metricDefinitionCacheAge.Metrics, metric)
+	}
+
+	metricDefinitionDropped := MetricDefinition{}
+	metricDefinitionDropped.Name = "query_series_dropped"
+	metricDefinitionDropped.Description = MetricDesc{
+		Help: "Returns the number of series of the query dropped by sample and max_series",
+		Type: "gauge",
+		Unit: "",
+	}
+
+	queries = make([]string, 0, len(s.seriesDropped))
+	for query := range s.seriesDropped {
+		queries = append(queries, query)
+	}
+	sort.Strings(queries)
+
+	for _, query := range queries {
+		metric := Metric{}
+		metric.Labels = make(map[string]string)
+		metric.Labels["query"] = query
+		metric.Value = float64(s.seriesDropped[query])
+		metricDefinitionDropped.Metrics = append(metricDefinitionDropped.Metrics, metric)
+	}
+
+	metricDefinitionBytes := MetricDefinition{}
+	metricDefinitionBytes.Name = "query_response"
+	metricDefinitionBytes.Description = MetricDesc{
+		Help: "Returns the size of the responses received from the apic for the query",
+		Type: "gauge",
+		Unit: "bytes",
+	}
+
+	queries = make([]string, 0, len(s.responseBytes))
+	for query := range s.responseBytes {
+		queries = append(queries, query)
+	}
+	sort.Strings(queries)
+
+	for _, query := range queries {
+		metric := Metric{}
+		metric.Labels = make(map[string]string)
+		metric.Labels["query"] = query
+		metric.Value = float64(s.responseBytes[query])
+		metricDefinitionBytes.Metrics = append(metricDefinitionBytes.Metrics, metric)
+	}
+
+	return []MetricDefinition{metricDefinition, metricDefinitionSuccess, metricDefinitionCacheAge, metricDefinitionDropped,
+		metricDefinitionBytes}
+}
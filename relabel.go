@@ -0,0 +1,154 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+// Copyright 2020 Opsdis AB
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/viper"
+	"github.com/umisama/go-regexpcache"
+)
+
+func init() {
+	registerMetricProcessor(relabel{})
+}
+
+const (
+	relabelReplace = "replace"
+	relabelKeep    = "keep"
+	relabelDrop    = "drop"
+)
+
+// relabelRule is a rule of the relabel processor, a subset of the Prometheus relabel_configs. The values of the
+// source labels are joined by the separator and matched with the regex, that is anchored at both ends
+type relabelRule struct {
+	SourceLabels []string `mapstructure:"source_labels"`
+	Separator    string   `mapstructure:"separator"`
+	Regex        string   `mapstructure:"regex"`
+	TargetLabel  string   `mapstructure:"target_label"`
+	Replacement  string   `mapstructure:"replacement"`
+	Action       string   `mapstructure:"action"`
+}
+
+// relabel apply the rules of metric_processors.relabel.metrics.<metric name> to the series of the metric. The series
+// is dropped by the drop and keep actions, and the label target_label is set to the expanded replacement by the
+// replace action. The rules of a metric are applied in order
+type relabel struct{}
+
+func (relabel) Name() string {
+	return "relabel"
+}
+
+func (relabel) Process(fabric string, metrics []MetricDefinition) ([]MetricDefinition, error) {
+	rules := make(map[string][]relabelRule)
+	err := viper.UnmarshalKey("metric_processors.relabel.metrics", &rules)
+	if err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 {
+		return metrics, nil
+	}
+
+	var relabeled []MetricDefinition
+	for _, metricDefinition := range metrics {
+		metricRules, ok := rules[metricDefinition.Name]
+		if !ok {
+			relabeled = append(relabeled, metricDefinition)
+			continue
+		}
+
+		var series []Metric
+		for _, metric := range metricDefinition.Metrics {
+			labels, keep, err := relabelSeries(metric.Labels, metricRules)
+			if err != nil {
+				return nil, fmt.Errorf("metric %s - %s", metricDefinition.Name, err)
+			}
+			if keep {
+				metric.Labels = labels
+				series = append(series, metric)
+			}
+		}
+		// A metric without any series is not returned
+		if len(series) == 0 {
+			continue
+		}
+		metricDefinition.Metrics = series
+		relabeled = append(relabeled, metricDefinition)
+	}
+	return relabeled, nil
+}
+
+// relabelSeries apply the rules to the labels of a series and return the new labels and if the series is kept. The
+// labels are copied, since the label map may be shared with other series
+func relabelSeries(labels map[string]string, rules []relabelRule) (map[string]string, bool, error) {
+	relabeled := make(map[string]string)
+	for k, v := range labels {
+		relabeled[k] = v
+	}
+
+	for _, rule := range rules {
+		regex := rule.Regex
+		if regex == "" {
+			regex = "(.*)"
+		}
+		re, err := regexpcache.Compile("^(?:" + regex + ")$")
+		if err != nil {
+			return nil, false, err
+		}
+
+		separator := rule.Separator
+		if separator == "" {
+			separator = ";"
+		}
+		var values []string
+		for _, name := range rule.SourceLabels {
+			values = append(values, relabeled[name])
+		}
+		value := strings.Join(values, separator)
+
+		switch rule.Action {
+		case relabelReplace, "":
+			if rule.TargetLabel == "" {
+				return nil, false, fmt.Errorf("the replace action require a target_label")
+			}
+			match := re.FindStringSubmatchIndex(value)
+			if match == nil {
+				continue
+			}
+			replacement := rule.Replacement
+			if replacement == "" {
+				replacement = "$1"
+			}
+			result := string(re.ExpandString(nil, replacement, value, match))
+			// As in Prometheus an empty value remove the label
+			if result == "" {
+				delete(relabeled, rule.TargetLabel)
+			} else {
+				relabeled[rule.TargetLabel] = result
+			}
+		case relabelKeep:
+			if !re.MatchString(value) {
+				return nil, false, nil
+			}
+		case relabelDrop:
+			if re.MatchString(value) {
+				return nil, false, nil
+			}
+		default:
+			return nil, false, fmt.Errorf("not a valid relabel action %s", rule.Action)
+		}
+	}
+	return relabeled, true, nil
+}
@@ -0,0 +1,186 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+// Copyright 2020 Opsdis AB
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var remoteWriteFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: MetricsPrefix + "remote_write_failed_total",
+	Help: "Number of failed pushes of fabric metrics to the remote write endpoint",
+},
+	[]string{"fabric"},
+)
+
+// remoteWriter collect the metrics of the fabrics on an interval and push them to a Prometheus remote write endpoint
+type remoteWriter struct {
+	url        string
+	interval   time.Duration
+	username   string
+	password   string
+	fabrics    []string
+	queries    string
+	allQueries AllQueries
+	client     *http.Client
+}
+
+func newRemoteWriter(allQueries AllQueries) *remoteWriter {
+	fabrics := viper.GetStringSlice("remote_write.fabrics")
+	if len(fabrics) == 0 {
+		for fabric := range viper.GetStringMap("fabrics") {
+			fabrics = append(fabrics, fabric)
+		}
+	}
+	sort.Strings(fabrics)
+
+	return &remoteWriter{
+		url:        viper.GetString("remote_write.url"),
+		interval:   viper.GetDuration("remote_write.interval") * time.Second,
+		username:   viper.GetString("remote_write.username"),
+		password:   viper.GetString("remote_write.password"),
+		fabrics:    fabrics,
+		queries:    viper.GetString("remote_write.queries"),
+		allQueries: allQueries,
+		client:     &http.Client{Timeout: viper.GetDuration("remote_write.timeout") * time.Second},
+	}
+}
+
+// run collect and push the metrics of all fabrics on every interval
+func (w *remoteWriter) run() {
+	log.WithFields(log.Fields{
+		"url":      w.url,
+		"interval": w.interval.String(),
+		"fabrics":  strings.Join(w.fabrics, ","),
+	}).Info("remote write started")
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, fabric := range w.fabrics {
+			wg.Add(1)
+			go func(fabric string) {
+				defer wg.Done()
+				err := w.push(fabric)
+				if err != nil {
+					remoteWriteFailed.WithLabelValues(fabric).Inc()
+					log.WithFields(log.Fields{
+						"fabric": fabric,
+					}).Error("remote write failed - ", err)
+				}
+			}(fabric)
+		}
+		wg.Wait()
+		<-ticker.C
+	}
+}
+
+// push collect the metrics of the fabric and write them to the remote write endpoint
+func (w *remoteWriter) push(fabric string) error {
+	ctx := context.WithValue(context.Background(), "requestid", nextRequestID())
+	timestamp := time.Now()
+	metrics, prefix, commonLabels, _ := collectFabric(ctx, fabric, w.allQueries, w.queries)
+
+	timeSeries := Metrics2TimeSeries(metrics, prefix, commonLabels, timestamp)
+	if len(timeSeries) == 0 {
+		return nil
+	}
+
+	body := snappy.Encode(nil, encodeWriteRequest(timeSeries))
+	req, err := http.NewRequest("POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if w.username != "" {
+		req.SetBasicAuth(w.username, w.password)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("remote write endpoint returned %d - %s", resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
+
+// encodeWriteRequest encode the time series as a remote write protobuf WriteRequest message
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(timeSeries []TimeSeries) []byte {
+	var request []byte
+	for _, ts := range timeSeries {
+		var series []byte
+
+		// Labels must be sorted by name
+		names := make([]string, 0, len(ts.Labels))
+		for name := range ts.Labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			var label []byte
+			label = protowire.AppendTag(label, 1, protowire.BytesType)
+			label = protowire.AppendString(label, name)
+			label = protowire.AppendTag(label, 2, protowire.BytesType)
+			label = protowire.AppendString(label, ts.Labels[name])
+
+			series = protowire.AppendTag(series, 1, protowire.BytesType)
+			series = protowire.AppendBytes(series, label)
+		}
+
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(ts.Value))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(ts.Timestamp))
+
+		series = protowire.AppendTag(series, 2, protowire.BytesType)
+		series = protowire.AppendBytes(series, sample)
+
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, series)
+	}
+	return request
+}
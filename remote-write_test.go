@@ -0,0 +1,108 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+// Copyright 2020 Opsdis AB
+
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// protoField is a decoded field of a protobuf message, the value of a bytes field is []byte and of a fixed64 or varint
+// field uint64
+type protoField struct {
+	number protowire.Number
+	value  interface{}
+}
+
+// decodeFields return the fields of a protobuf message in order
+func decodeFields(t *testing.T, message []byte) []protoField {
+	t.Helper()
+	var fields []protoField
+	for len(message) > 0 {
+		number, wireType, n := protowire.ConsumeTag(message)
+		if n < 0 {
+			t.Fatal(protowire.ParseError(n))
+		}
+		message = message[n:]
+		var value interface{}
+		switch wireType {
+		case protowire.BytesType:
+			value, n = protowire.ConsumeBytes(message)
+		case protowire.Fixed64Type:
+			value, n = protowire.ConsumeFixed64(message)
+		case protowire.VarintType:
+			value, n = protowire.ConsumeVarint(message)
+		default:
+			t.Fatalf("unexpected wire type %d of field %d", wireType, number)
+		}
+		if n < 0 {
+			t.Fatal(protowire.ParseError(n))
+		}
+		message = message[n:]
+		fields = append(fields, protoField{number: number, value: value})
+	}
+	return fields
+}
+
+func TestEncodeWriteRequest(t *testing.T) {
+	timeSeries := []TimeSeries{
+		{Labels: map[string]string{"__name__": "aci_up", "fabric": "f1", "aci": "A"}, Value: 1, Timestamp: 1700000000000},
+		{Labels: map[string]string{"__name__": "aci_fabric_health", "podid": "1"}, Value: 0.95, Timestamp: 1700000000001},
+	}
+
+	type series struct {
+		labels    [][2]string
+		value     float64
+		timestamp int64
+	}
+	var actual []series
+	for _, request := range decodeFields(t, encodeWriteRequest(timeSeries)) {
+		if request.number != 1 {
+			t.Fatalf("WriteRequest: unexpected field %d", request.number)
+		}
+		s := series{}
+		for _, field := range decodeFields(t, request.value.([]byte)) {
+			switch field.number {
+			case 1:
+				label := decodeFields(t, field.value.([]byte))
+				if len(label) != 2 || label[0].number != 1 || label[1].number != 2 {
+					t.Fatalf("Label: unexpected fields %v", label)
+				}
+				s.labels = append(s.labels, [2]string{string(label[0].value.([]byte)), string(label[1].value.([]byte))})
+			case 2:
+				sample := decodeFields(t, field.value.([]byte))
+				if len(sample) != 2 || sample[0].number != 1 || sample[1].number != 2 {
+					t.Fatalf("Sample: unexpected fields %v", sample)
+				}
+				s.value = math.Float64frombits(sample[0].value.(uint64))
+				s.timestamp = int64(sample[1].value.(uint64))
+			default:
+				t.Fatalf("TimeSeries: unexpected field %d", field.number)
+			}
+		}
+		actual = append(actual, s)
+	}
+
+	// The labels are sorted by name
+	expected := []series{
+		{labels: [][2]string{{"__name__", "aci_up"}, {"aci", "A"}, {"fabric", "f1"}}, value: 1, timestamp: 1700000000000},
+		{labels: [][2]string{{"__name__", "aci_fabric_health"}, {"podid", "1"}}, value: 0.95, timestamp: 1700000000001},
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("got %v, expected %v", actual, expected)
+	}
+}
@@ -0,0 +1,155 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+// Copyright 2020 Opsdis AB
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// loginSessions hold the cached login sessions by fabric name, only when session_cache is enabled
+var loginSessions = make(map[string]*loginSession)
+
+// loginSession is a login session to a fabric that is kept refreshed in the background, so the scrapes can use it
+// without a login of their own
+type loginSession struct {
+	fabric       string
+	fabricConfig Fabric
+	mutex        sync.RWMutex
+	valid        bool
+	controller   int
+	apic         *url.URL
+	cookies      []*http.Cookie
+	relogin      chan struct{}
+}
+
+func newLoginSession(fabric string, fabricConfig Fabric) *loginSession {
+	return &loginSession{
+		fabric:       fabric,
+		fabricConfig: fabricConfig,
+		relogin:      make(chan struct{}, 1),
+	}
+}
+
+// run login to the fabric and refresh the session. If the login fail, e.g. since the apic is not reachable, the login
+// is retried until it succeed
+func (s *loginSession) run() {
+	retry := viper.GetDuration("session_cache.retry_interval") * time.Second
+	for {
+		err := s.keep()
+		s.mutex.Lock()
+		s.valid = false
+		s.mutex.Unlock()
+		if isLoginError(err) {
+			log.WithFields(log.Fields{
+				"fabric": s.fabric,
+			}).Error(fmt.Sprintf("cached login session stopped, the login is not retried - %s", err))
+			return
+		}
+		log.WithFields(log.Fields{
+			"fabric": s.fabric,
+		}).Error(fmt.Sprintf("cached login session failed, login again in %s - %s", retry, err))
+		time.Sleep(retry)
+	}
+}
+
+// keep a login session valid until the refresh fail or the session is invalidated by a scrape
+func (s *loginSession) keep() error {
+	ctx := context.WithValue(context.Background(), "fabric", s.fabric)
+	con := newAciConnction(ctx, s.fabricConfig)
+
+	err := con.login()
+	if err != nil {
+		return err
+	}
+	defer con.logout()
+
+	// Ignore any invalidation of the previous session
+	select {
+	case <-s.relogin:
+	default:
+	}
+
+	err = s.update(con)
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"fabric": s.fabric,
+	}).Info(fmt.Sprintf("cached login session to %s established", con.activeApic()))
+
+	refresh := time.NewTicker(viper.GetDuration("session_cache.refresh_interval") * time.Second)
+	defer refresh.Stop()
+	for {
+		select {
+		case <-refresh.C:
+			err := con.refresh()
+			if err != nil {
+				return err
+			}
+			err = s.update(con)
+			if err != nil {
+				return err
+			}
+		case <-s.relogin:
+			return fmt.Errorf("session not valid")
+		}
+	}
+}
+
+// update the session from the session cookies of the connection
+func (s *loginSession) update(con *AciConnection) error {
+	apic, err := url.Parse(con.activeApic())
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.valid = true
+	s.controller = *con.activeController
+	s.apic = apic
+	s.cookies = con.Client.Jar.Cookies(apic)
+	return nil
+}
+
+// use the session for the connection, return false if there is no valid session
+func (s *loginSession) use(con AciConnection) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if !s.valid {
+		return false
+	}
+	*con.activeController = s.controller
+	con.Client.Jar.SetCookies(s.apic, s.cookies)
+	return true
+}
+
+// invalidate the session, e.g. if a scrape could not use it, and login again
+func (s *loginSession) invalidate() {
+	s.mutex.Lock()
+	s.valid = false
+	s.mutex.Unlock()
+	select {
+	case s.relogin <- struct{}{}:
+	default:
+	}
+}
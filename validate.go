@@ -0,0 +1,115 @@
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+//
+// Copyright 2020 Opsdis AB
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// validation is the result of executing all queries of a fabric once
+type validation struct {
+	Fabric  string            `json:"fabric"`
+	Passed  bool              `json:"passed"`
+	Queries []queryValidation `json:"queries"`
+}
+
+// queryValidation is the result of a query, the number of series of each metric of the query. A query passed if it
+// was successful and all its metrics have series, else the paths of the query may not match the apic response
+type queryValidation struct {
+	Query   string         `json:"query"`
+	Success bool           `json:"success"`
+	Passed  bool           `json:"passed"`
+	Metrics []metricSeries `json:"metrics"`
+}
+
+type metricSeries struct {
+	Name   string `json:"name"`
+	Series int    `json:"series"`
+}
+
+// ValidateQueries execute each query of the fabric once, in parallel with the same login, and return the number of
+// series of each metric by query. The metric names are the names before any rename by metric_names
+func (p aciAPI) ValidateQueries() (validation, error) {
+	result := validation{Fabric: fmt.Sprintf("%v", p.ctx.Value("fabric")), Passed: true}
+
+	_, logout, err := p.login()
+	if logout {
+		defer p.connection.logout()
+	}
+	if err != nil {
+		return result, err
+	}
+
+	names := p.queryNames()
+	sort.Strings(names)
+	result.Queries = make([]queryValidation, len(names))
+
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			var metricDefinitions []MetricDefinition
+			ch := make(chan []MetricDefinition, 1)
+			p.onlyQuery(name).runQueries(ch)
+			select {
+			case metricDefinitions = <-ch:
+			case <-p.ctx.Done():
+			}
+			result.Queries[i] = validateQuery(name, p.stats.succeeded(name), metricDefinitions)
+		}(i, name)
+	}
+	wg.Wait()
+
+	for _, query := range result.Queries {
+		result.Passed = result.Passed && query.Passed
+	}
+	return result, nil
+}
+
+// validateQuery return the number of series of each metric of the query, and if the query passed
+func validateQuery(name string, success bool, metricDefinitions []MetricDefinition) queryValidation {
+	query := queryValidation{Query: name, Success: success, Passed: success && len(metricDefinitions) > 0}
+	for _, metricDefinition := range metricDefinitions {
+		query.Metrics = append(query.Metrics, metricSeries{Name: metricDefinition.Name, Series: len(metricDefinition.Metrics)})
+		if len(metricDefinition.Metrics) == 0 {
+			query.Passed = false
+		}
+	}
+	return query
+}
+
+// onlyQuery return a copy of the api with only the named query
+func (p aciAPI) onlyQuery(name string) aciAPI {
+	api := p
+	api.configQueries = ClassQueries{}
+	api.configCompoundQueries = CompoundClassQueries{}
+	api.configGroupQueries = GroupClassQueries{}
+	api.confgBuiltInQueries = BuilitinQueries{}
+	if query, ok := p.configQueries[name]; ok {
+		api.configQueries[name] = query
+	}
+	if query, ok := p.configCompoundQueries[name]; ok {
+		api.configCompoundQueries[name] = query
+	}
+	if query, ok := p.configGroupQueries[name]; ok {
+		api.configGroupQueries[name] = query
+	}
+	if query, ok := p.confgBuiltInQueries[name]; ok {
+		api.confgBuiltInQueries[name] = query
+	}
+	return api
+}